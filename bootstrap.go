@@ -2,364 +2,773 @@ package dbstrap
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
+	"sort"
 	"strings"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"gopkg.in/yaml.v3"
 )
 
 var DefaultYAML []byte
 
+// RoleAttributes are the role options set by CREATE ROLE and ALTER ROLE.
+// Unset fields are left as they are on existing roles.
+type RoleAttributes struct {
+	Superuser       *bool `yaml:"superuser,omitempty"`
+	CreateDB        *bool `yaml:"createdb,omitempty"`
+	CreateRole      *bool `yaml:"createrole,omitempty"`
+	Replication     *bool `yaml:"replication,omitempty"`
+	BypassRLS       *bool `yaml:"bypassrls,omitempty"`
+	Inherit         *bool `yaml:"inherit,omitempty"`
+	ConnectionLimit *int  `yaml:"connection_limit,omitempty"`
+	// ValidUntil is a timestamp or "infinity"; timestamps without a zone are UTC
+	ValidUntil string `yaml:"valid_until,omitempty"`
+}
+
 type User struct {
-	Name        string   `yaml:"name"`
-	PasswordEnv string   `yaml:"password_env"`
-	Password    string   // populated at runtime
-	CanLogin    bool     `yaml:"can_login"`
-	OwnsSchemas []string `yaml:"owns_schemas"`
-	Roles       []string `yaml:"roles"`
+	Name        string `yaml:"name,omitempty"`
+	PasswordEnv string `yaml:"password_env,omitempty"`
+	// PasswordFile is read for the password, such as a mounted Docker or
+	// Kubernetes secret; trailing newlines are trimmed
+	PasswordFile string `yaml:"password_file,omitempty"`
+	// PasswordCommand is an executable and its arguments, run without a
+	// shell; the password is read from its standard output
+	PasswordCommand []string `yaml:"password_command,omitempty"`
+	// PasswordVault is a Vault KV v2 secret and key, written as
+	// secret/data/db/app#password
+	PasswordVault  string   `yaml:"password_vault,omitempty"`
+	Password       string   `yaml:"-"` // populated at runtime
+	CanLogin       bool     `yaml:"can_login,omitempty"`
+	OwnsSchemas    []string `yaml:"owns_schemas,omitempty"`
+	Roles          []string `yaml:"roles,omitempty"`
+	RoleAttributes `yaml:",inline"`
+	// SyncPassword sets the password of an existing role on every run instead
+	// of only when the role is created; unset follows BOOTSTRAP_SYNC_PASSWORDS
+	SyncPassword *bool `yaml:"sync_password,omitempty"`
+	// Settings are configuration parameters set for the user in every
+	// database, such as statement_timeout
+	Settings map[string]string `yaml:"settings,omitempty"`
+}
+
+// Role is a NOLOGIN group role that users and other roles are granted
+type Role struct {
+	Name           string   `yaml:"name,omitempty"`
+	Roles          []string `yaml:"roles,omitempty"`
+	RoleAttributes `yaml:",inline"`
+	// Settings are configuration parameters set for the role in every
+	// database; PostgreSQL applies them only to sessions that log in as it
+	Settings map[string]string `yaml:"settings,omitempty"`
+}
+
+// syncPassword reports whether the password of an existing role is kept in
+// sync with the configured value
+func (u User) syncPassword() bool {
+	return u.SyncPassword != nil && *u.SyncPassword
 }
 
 // SchemaGrant represents a grant of privileges on a schema to a user or role
 type SchemaGrant struct {
-	User                string   `yaml:"user"`
-	Role                string   `yaml:"role"`
-	Privileges          []string `yaml:"privileges"`
-	TablePrivileges     []string `yaml:"table_privileges"`
-	SequencePrivileges  []string `yaml:"sequence_privileges"`
-	FunctionPrivileges  []string `yaml:"function_privileges"`
-	DefaultPrivileges   []string `yaml:"default_privileges"`
+	User               string   `yaml:"user,omitempty"`
+	Role               string   `yaml:"role,omitempty"`
+	Privileges         []string `yaml:"privileges,omitempty"`
+	TablePrivileges    []string `yaml:"table_privileges,omitempty"`
+	SequencePrivileges []string `yaml:"sequence_privileges,omitempty"`
+	FunctionPrivileges []string `yaml:"function_privileges,omitempty"`
+	// DefaultPrivileges apply to tables created in the schema by the roles in
+	// ForRoles; the other default privileges cover the remaining object
+	// classes
+	DefaultPrivileges         []string `yaml:"default_privileges,omitempty"`
+	DefaultSequencePrivileges []string `yaml:"default_sequence_privileges,omitempty"`
+	DefaultFunctionPrivileges []string `yaml:"default_function_privileges,omitempty"`
+	DefaultTypePrivileges     []string `yaml:"default_type_privileges,omitempty"`
+	// ForRoles are the roles whose future objects the default privileges
+	// cover; unset falls back to Schema.ForRoles
+	ForRoles []string `yaml:"for_roles,omitempty"`
+	// Objects grants privileges on individual objects in the schema
+	Objects []ObjectGrant `yaml:"objects,omitempty"`
+}
+
+// ObjectGrant grants privileges on a single table, view, sequence or function
+type ObjectGrant struct {
+	// Type is table, view, sequence or function
+	Type string `yaml:"type,omitempty"`
+	Name string `yaml:"name,omitempty"`
+	// Args is the argument list of a function, such as "integer, text",
+	// resolved by the server; empty for functions without arguments
+	Args       string   `yaml:"args,omitempty"`
+	Privileges []string `yaml:"privileges,omitempty"`
+}
+
+// objectGrantKinds maps ObjectGrant.Type to object kinds; views are granted
+// like tables
+var objectGrantKinds = map[string]objectKind{
+	"table":    kindTable,
+	"view":     kindTable,
+	"sequence": kindSequence,
+	"function": kindFunction,
+}
+
+// kind returns the object kind the grant applies to
+func (g ObjectGrant) kind() (objectKind, error) {
+	kind, ok := objectGrantKinds[strings.ToLower(g.Type)]
+	if !ok {
+		return "", fmt.Errorf("object %s: invalid type %q; expected table, view, sequence or function", g.Name, g.Type)
+	}
+	return kind, nil
+}
+
+// key returns the name the catalog knows the object by
+func (g ObjectGrant) key(kind objectKind) string {
+	if kind == kindFunction {
+		return g.Name + "(" + g.Args + ")"
+	}
+	return g.Name
+}
+
+// allObjectPrivileges returns the privileges granted on all existing objects of
+// the given kind in the schema
+func (g SchemaGrant) allObjectPrivileges(kind objectKind) []string {
+	switch kind {
+	case kindTable:
+		return g.TablePrivileges
+	case kindSequence:
+		return g.SequencePrivileges
+	case kindFunction:
+		return g.FunctionPrivileges
+	}
+	return nil
+}
+
+// defaultPrivilegeKinds are the object classes default privileges are
+// declared for
+var defaultPrivilegeKinds = []objectKind{kindTable, kindSequence, kindFunction, kindType}
+
+// defaultPrivileges returns the privileges granted on objects of the given
+// kind that the schema owner creates in the future
+func (g SchemaGrant) defaultPrivileges(kind objectKind) []string {
+	switch kind {
+	case kindTable:
+		return g.DefaultPrivileges
+	case kindSequence:
+		return g.DefaultSequencePrivileges
+	case kindFunction:
+		return g.DefaultFunctionPrivileges
+	case kindType:
+		return g.DefaultTypePrivileges
+	}
+	return nil
 }
 
 type Schema struct {
-	Name   string        `yaml:"name"`
-	Owner  string        `yaml:"owner"`
-	Grants []SchemaGrant `yaml:"grants"`
+	Name   string        `yaml:"name,omitempty"`
+	Owner  string        `yaml:"owner,omitempty"`
+	Grants []SchemaGrant `yaml:"grants,omitempty"`
+	// ForRoles are the roles whose future objects the default privileges of
+	// every grant cover; unset means the schema owner
+	ForRoles     []string           `yaml:"for_roles,omitempty"`
+	ColumnGrants []ColumnGrant      `yaml:"column_grants,omitempty"`
+	RowSecurity  []TableRowSecurity `yaml:"row_security,omitempty"`
+	// ReassignObjects makes Owner the owner of every table, view, sequence
+	// and function in the schema
+	ReassignObjects bool `yaml:"reassign_objects,omitempty"`
 }
 
-type DatabaseGrant struct {
-	User       string   `yaml:"user"`
-	Privileges []string `yaml:"privileges"`
+// defaultCreators returns the roles whose future objects the default
+// privileges of grant cover. Without for_roles that is the schema owner, or
+// the connecting user, who creates a schema without one. An empty name is
+// left only when rendering against an empty catalog.
+func (s Schema) defaultCreators(grant SchemaGrant, catalog *databaseCatalog) []string {
+	if len(grant.ForRoles) > 0 {
+		return grant.ForRoles
+	}
+	if len(s.ForRoles) > 0 {
+		return s.ForRoles
+	}
+	if owner := schemaOwner(s, catalog.schemas[s.Name]); owner != "" {
+		return []string{owner}
+	}
+	return []string{catalog.currentUser}
 }
 
-type Database struct {
-	Name       string          `yaml:"name"`
-	Owner      string          `yaml:"owner"`
-	Encoding   string          `yaml:"encoding"`
-	LcCollate  string          `yaml:"lc_collate"`
-	LcCtype    string          `yaml:"lc_ctype"`
-	Template   string          `yaml:"template"`
-	Extensions []string        `yaml:"extensions"`
-	Grants     []DatabaseGrant `yaml:"grants"`
-	Schemas    []Schema        `yaml:"schemas"`
+// ColumnGrant grants privileges on some columns of a table to a user or role
+type ColumnGrant struct {
+	Table      string   `yaml:"table,omitempty"`
+	Columns    []string `yaml:"columns,omitempty"`
+	User       string   `yaml:"user,omitempty"`
+	Role       string   `yaml:"role,omitempty"`
+	Privileges []string `yaml:"privileges,omitempty"`
 }
 
-type Config struct {
-	Users     []User     `yaml:"users"`
-	Databases []Database `yaml:"databases"`
+// grantee returns the user or role the column grant applies to
+func (g ColumnGrant) grantee() (string, error) {
+	return userOrRole("column grant", g.User, g.Role)
 }
 
-func getEnvBool(key string) bool {
-	v := os.Getenv(key)
-	return strings.ToLower(v) == "true" || v == "1" || v == "yes"
+// TableRowSecurity declares row-level security for a table in the schema
+type TableRowSecurity struct {
+	Table string `yaml:"table,omitempty"`
+	// Enable turns row-level security on or off; unset leaves it as it is
+	Enable *bool `yaml:"enable,omitempty"`
+	// Force applies the policies to the table owner as well
+	Force    *bool    `yaml:"force,omitempty"`
+	Policies []Policy `yaml:"policies,omitempty"`
 }
 
-// Note: LoadAndRenderSQL function has been removed as we now handle extensions at the database level
+// Policy is a row-level security policy on a table
+type Policy struct {
+	Name string `yaml:"name,omitempty"`
+	// Command is ALL, SELECT, INSERT, UPDATE or DELETE; unset means ALL
+	Command string `yaml:"command,omitempty"`
+	// Restrictive policies must all pass, permissive ones are combined with OR
+	Restrictive bool `yaml:"restrictive,omitempty"`
+	// Roles the policy applies to; unset means PUBLIC
+	Roles     []string `yaml:"roles,omitempty"`
+	Using     string   `yaml:"using,omitempty"`
+	WithCheck string   `yaml:"with_check,omitempty"`
+}
 
-// createDatabases creates databases directly through the database connection
-func createDatabases(ctx context.Context, dbURL string, databases []Database) error {
-	if len(databases) == 0 {
-		return nil
+// command returns the policy command in upper case, defaulting to ALL
+func (p Policy) command() string {
+	if p.Command == "" {
+		return "ALL"
 	}
+	return strings.ToUpper(p.Command)
+}
 
-	// Connect to the default database
-	slog.Info("Connecting to database to create databases")
-	conn, err := pgx.Connect(ctx, dbURL)
-	if err != nil {
-		return fmt.Errorf("failed to connect to database: %w", err)
+// roles returns the canonical role names the policy applies to, sorted
+func (p Policy) roles() []string {
+	if len(p.Roles) == 0 {
+		return []string{"PUBLIC"}
 	}
-	defer conn.Close(ctx)
+	roles := make([]string, len(p.Roles))
+	for i, role := range p.Roles {
+		roles[i] = canonicalGrantee(role)
+	}
+	sort.Strings(roles)
+	return roles
+}
 
-	// Create each database
-	for _, db := range databases {
-		// Check if database exists
-		var exists bool
-		err := conn.QueryRow(ctx, "SELECT EXISTS(SELECT 1 FROM pg_database WHERE datname = $1)", db.Name).Scan(&exists)
-		if err != nil {
-			return fmt.Errorf("failed to check if database exists: %w", err)
+// validate checks the command and that it allows the clauses given
+func (p Policy) validate() error {
+	if p.Name == "" {
+		return fmt.Errorf("policy must have a name")
+	}
+	switch p.command() {
+	case "ALL", "UPDATE":
+	case "SELECT", "DELETE":
+		if p.WithCheck != "" {
+			return fmt.Errorf("policy %s: %s policies can't have with_check", p.Name, p.command())
 		}
+	case "INSERT":
+		if p.Using != "" {
+			return fmt.Errorf("policy %s: INSERT policies can't have using", p.Name)
+		}
+	default:
+		return fmt.Errorf("policy %s: invalid command %q; expected ALL, SELECT, INSERT, UPDATE or DELETE", p.Name, p.Command)
+	}
+	return nil
+}
 
-		if !exists {
-			// Build CREATE DATABASE command
-			createCmd := fmt.Sprintf("CREATE DATABASE %s", db.Name)
+// Tablespace is a directory on the database server that databases and tables
+// can be stored in. It is created before databases.
+type Tablespace struct {
+	Name string `yaml:"name,omitempty"`
+	// Location is an absolute path that must exist, be empty and belong to
+	// the server's operating system user
+	Location string `yaml:"location,omitempty"`
+	Owner    string `yaml:"owner,omitempty"`
+	// Options are tablespace parameters such as random_page_cost
+	Options map[string]string `yaml:"options,omitempty"`
+	Grants  []TablespaceGrant `yaml:"grants,omitempty"`
+}
 
-			if db.Owner != "" {
-				createCmd += fmt.Sprintf(" OWNER %s", db.Owner)
-			}
-			if db.Encoding != "" {
-				createCmd += fmt.Sprintf(" ENCODING '%s'", db.Encoding)
-			}
-			if db.LcCollate != "" {
-				createCmd += fmt.Sprintf(" LC_COLLATE '%s'", db.LcCollate)
-			}
-			if db.LcCtype != "" {
-				createCmd += fmt.Sprintf(" LC_CTYPE '%s'", db.LcCtype)
-			}
-			if db.Template != "" {
-				createCmd += fmt.Sprintf(" TEMPLATE %s", db.Template)
-			}
+type TablespaceGrant struct {
+	User       string   `yaml:"user,omitempty"`
+	Privileges []string `yaml:"privileges,omitempty"`
+}
 
-			slog.Info("Creating database", "name", db.Name)
-			// Execute the CREATE DATABASE command
-			_, err = conn.Exec(ctx, createCmd)
-			if err != nil {
-				return fmt.Errorf("failed to create database %s: %w", db.Name, err)
-			}
-			slog.Info("Created database", "name", db.Name)
-		} else {
-			slog.Info("Database already exists", "name", db.Name)
+type DatabaseGrant struct {
+	User       string   `yaml:"user,omitempty"`
+	Privileges []string `yaml:"privileges,omitempty"`
+}
+
+// Extension is an extension installed in a database. In YAML it is either the
+// extension's name or a mapping with its options.
+type Extension struct {
+	Name string `yaml:"name,omitempty"`
+	// Version pins the extension; existing extensions at another version are
+	// updated to it. Unset installs the default version.
+	Version string `yaml:"version,omitempty"`
+	// Schema holds the extension's objects; it must exist already
+	Schema string `yaml:"schema,omitempty"`
+	// Cascade also installs the extensions this one requires
+	Cascade bool `yaml:"cascade,omitempty"`
+}
+
+// extensionKeys are the keys an extension mapping accepts
+var extensionKeys = []string{"name", "version", "schema", "cascade"}
+
+func (e *Extension) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		return node.Decode(&e.Name)
+	}
+	type plain Extension
+	return node.Decode((*plain)(e))
+}
+
+func (e Extension) MarshalYAML() (any, error) {
+	if e.Version == "" && e.Schema == "" && !e.Cascade {
+		return e.Name, nil
+	}
+	type plain Extension
+	return plain(e), nil
+}
+
+type Database struct {
+	Name      string `yaml:"name,omitempty"`
+	Owner     string `yaml:"owner,omitempty"`
+	Encoding  string `yaml:"encoding,omitempty"`
+	LcCollate string `yaml:"lc_collate,omitempty"`
+	LcCtype   string `yaml:"lc_ctype,omitempty"`
+	Template  string `yaml:"template,omitempty"`
+	// LocaleProvider is libc, icu or builtin; like the encoding and locales
+	// it is fixed when the database is created
+	LocaleProvider   string `yaml:"locale_provider,omitempty"`
+	IcuLocale        string `yaml:"icu_locale,omitempty"`
+	CollationVersion string `yaml:"collation_version,omitempty"`
+	// ConnectionLimit, Tablespace, AllowConnections and IsTemplate are
+	// applied to existing databases with ALTER DATABASE
+	ConnectionLimit  *int            `yaml:"connection_limit,omitempty"`
+	Tablespace       string          `yaml:"tablespace,omitempty"`
+	AllowConnections *bool           `yaml:"allow_connections,omitempty"`
+	IsTemplate       *bool           `yaml:"is_template,omitempty"`
+	Extensions       []Extension     `yaml:"extensions,omitempty"`
+	Grants           []DatabaseGrant `yaml:"grants,omitempty"`
+	Schemas          []Schema        `yaml:"schemas,omitempty"`
+	// Settings are configuration parameters set for every session in the
+	// database
+	Settings map[string]string `yaml:"settings,omitempty"`
+	// RoleSettings are configuration parameters set for a role's sessions in
+	// this database, keyed by role
+	RoleSettings map[string]map[string]string `yaml:"role_settings,omitempty"`
+}
+
+// declaresSchema reports whether the database declares a schema named name
+func (d Database) declaresSchema(name string) bool {
+	for _, schema := range d.Schemas {
+		if schema.Name == name {
+			return true
 		}
+	}
+	return false
+}
 
-		// Apply grants
-		for _, grant := range db.Grants {
-			privileges := strings.Join(grant.Privileges, ", ")
-			grantCmd := fmt.Sprintf("GRANT %s ON DATABASE %s TO %s", privileges, db.Name, grant.User)
-			slog.Info("Applying grant", "database", db.Name, "user", grant.User, "privileges", privileges)
-			_, err = conn.Exec(ctx, grantCmd)
-			if err != nil {
-				return fmt.Errorf("failed to grant privileges on database %s: %w", db.Name, err)
+type Config struct {
+	Roles       []Role       `yaml:"roles,omitempty"`
+	Users       []User       `yaml:"users,omitempty"`
+	Tablespaces []Tablespace `yaml:"tablespaces,omitempty"`
+	Databases   []Database   `yaml:"databases,omitempty"`
+	// ExternalRoles are roles managed outside the config that owners and
+	// grants may refer to; dbstrap never creates or changes them
+	ExternalRoles []string `yaml:"external_roles,omitempty"`
+}
+
+// resolveSchemaOwners applies User.OwnsSchemas to every database that declares
+// a schema of that name. The user becomes the schema's owner; a different
+// Schema.Owner or a second user claiming the same schema is a conflict.
+func resolveSchemaOwners(config *Config) error {
+	var errs []error
+	for _, user := range config.Users {
+		for _, name := range user.OwnsSchemas {
+			found := false
+			for i := range config.Databases {
+				db := &config.Databases[i]
+				for j := range db.Schemas {
+					schema := &db.Schemas[j]
+					if schema.Name != name {
+						continue
+					}
+					found = true
+					if schema.Owner != "" && schema.Owner != user.Name {
+						errs = append(errs, fmt.Errorf("schema %s in database %s: owner %s conflicts with owns_schemas of user %s",
+							name, db.Name, schema.Owner, user.Name))
+						continue
+					}
+					schema.Owner = user.Name
+				}
+			}
+			if !found {
+				slog.Warn("Schema in owns_schemas is not declared in any database", "user", user.Name, "schema", name)
 			}
 		}
 	}
+	return errors.Join(errs...)
+}
 
-	return nil
+func getEnvBool(key string) bool {
+	v := os.Getenv(key)
+	return strings.ToLower(v) == "true" || v == "1" || v == "yes"
 }
 
-// createUsers creates users directly through the database connection
-func createUsers(ctx context.Context, dbURL string, users []User) error {
-	if len(users) == 0 {
-		return nil
+// connect opens a connection to dbName on the server in dbURL; an empty dbName
+// keeps the database from the URL. Read-only connections reject any write.
+func connect(ctx context.Context, dbURL, dbName string, readOnly bool) (*pgx.Conn, error) {
+	dbConfig, err := pgx.ParseConfig(dbURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse database URL: %w", err)
+	}
+	if dbName != "" {
+		dbConfig.Database = dbName
+	}
+	if readOnly {
+		dbConfig.RuntimeParams["default_transaction_read_only"] = "on"
 	}
 
-	// Connect to the default database
-	slog.Info("Connecting to database to create users")
-	conn, err := pgx.Connect(ctx, dbURL)
+	conn, err := pgx.ConnectConfig(ctx, dbConfig)
 	if err != nil {
-		return fmt.Errorf("failed to connect to database: %w", err)
+		return nil, fmt.Errorf("failed to connect to database %s: %w", dbConfig.Database, err)
 	}
-	defer conn.Close(ctx)
+	return conn, nil
+}
 
-	// Create each user
-	for _, user := range users {
-		// Check if user exists
-		var exists bool
-		err := conn.QueryRow(ctx, "SELECT EXISTS(SELECT 1 FROM pg_roles WHERE rolname = $1)", user.Name).Scan(&exists)
-		if err != nil {
-			return fmt.Errorf("failed to check if user exists: %w", err)
+// execer runs statements; both *pgx.Conn and pgx.Tx implement it
+type execer interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+}
+
+// execSteps runs every step that changes something, skipping no-ops
+func execSteps(ctx context.Context, conn execer, steps []Step) error {
+	for _, step := range steps {
+		if step.Action == ActionNoop {
+			continue
 		}
+		slog.Info("Executing statement", "action", step.Action, "database", step.Database, "sql", step.String())
+		if _, err := conn.Exec(ctx, step.SQL); err != nil {
+			return fmt.Errorf("failed to execute %q: %w", step.String(), err)
+		}
+	}
+	return nil
+}
 
-		if !exists {
-			// Build CREATE ROLE command
-			createCmd := fmt.Sprintf("CREATE ROLE %s", user.Name)
-			if user.CanLogin {
-				createCmd += fmt.Sprintf(" WITH LOGIN PASSWORD '%s'", user.Password)
+// execStepsIn runs steps that may target different databases, running
+// cluster-wide steps on conn and each run of steps in the same database in a
+// transaction on its own connection
+func execStepsIn(ctx context.Context, dbURL string, conn *pgx.Conn, steps []Step) error {
+	for start := 0; start < len(steps); {
+		end := start
+		for end < len(steps) && steps[end].Database == steps[start].Database {
+			end++
+		}
+		if steps[start].Database == "" {
+			if err := execSteps(ctx, conn, steps[start:end]); err != nil {
+				return err
 			}
-
-			slog.Info("Creating user", "name", user.Name)
-			// Execute the CREATE ROLE command
-			_, err = conn.Exec(ctx, createCmd)
+		} else {
+			dbConn, err := connect(ctx, dbURL, steps[start].Database, false)
 			if err != nil {
-				return fmt.Errorf("failed to create user %s: %w", user.Name, err)
+				return err
 			}
-			slog.Info("Created user", "name", user.Name)
-		} else {
-			slog.Info("User already exists", "name", user.Name)
-		}
-
-		// Apply roles
-		for _, role := range user.Roles {
-			grantCmd := fmt.Sprintf("GRANT %s TO %s", role, user.Name)
-			slog.Info("Applying role grant", "user", user.Name, "role", role)
-			_, err = conn.Exec(ctx, grantCmd)
+			err = pgx.BeginFunc(ctx, dbConn, func(tx pgx.Tx) error {
+				return execSteps(ctx, tx, steps[start:end])
+			})
+			dbConn.Close(ctx)
 			if err != nil {
-				return fmt.Errorf("failed to grant role %s to user %s: %w", role, user.Name, err)
+				return err
 			}
 		}
+		start = end
 	}
-
 	return nil
 }
 
-// createSchemas creates schemas within a database
-func createSchemas(ctx context.Context, conn *pgx.Conn, schemas []Schema) error {
-	if len(schemas) == 0 {
-		return nil
+// runBootstrap plans the configuration against the live catalogs and, when
+// apply is true, executes the plan. Cluster-wide statements are planned and
+// applied before each database is inspected, so databases created in this run
+// can be connected to; they run one by one because CREATE DATABASE cannot run
+// inside a transaction. Without apply all connections are read-only and
+// databases that do not exist yet are planned against an empty catalog.
+func runBootstrap(ctx context.Context, dbURL string, config *Config, opts Options, apply bool) (*Plan, error) {
+	plan := &Plan{}
+
+	slog.Info("Connecting to database to inspect cluster")
+	conn, err := connect(ctx, dbURL, "", !apply)
+	if err != nil {
+		return nil, err
 	}
+	defer conn.Close(ctx)
 
-	// Create each schema
-	for _, schema := range schemas {
-		// Check if schema exists
-		var exists bool
-		err := conn.QueryRow(ctx, "SELECT EXISTS(SELECT 1 FROM information_schema.schemata WHERE schema_name = $1)", schema.Name).Scan(&exists)
-		if err != nil {
-			return fmt.Errorf("failed to check if schema exists: %w", err)
+	state, err := inspectCluster(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	available, err := inspectAvailableExtensions(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkExtensions(config.Databases, available); err != nil {
+		return nil, err
+	}
+
+	managed := managedSet{}
+	if opts.Prune {
+		if managed, err = inspectManaged(ctx, conn); err != nil {
+			return nil, err
 		}
+	}
 
-		if !exists {
-			// Build CREATE SCHEMA command
-			createCmd := fmt.Sprintf("CREATE SCHEMA %s AUTHORIZATION %s", schema.Name, schema.Owner)
+	// 1. Group roles first, then users, tablespaces, databases and settings
+	steps, err := planRoles(config.Roles, state)
+	if err != nil {
+		return nil, err
+	}
+	userSteps, err := planUsers(config.Users, state)
+	if err != nil {
+		return nil, err
+	}
+	steps = append(steps, userSteps...)
+	tablespaceSteps, err := planTablespaces(config.Tablespaces, state, opts)
+	if err != nil {
+		return nil, err
+	}
+	steps = append(steps, tablespaceSteps...)
+	dbSteps, err := planDatabases(config.Databases, state, opts)
+	if err != nil {
+		return nil, err
+	}
+	steps = append(steps, dbSteps...)
+	steps = append(steps, planSettings(config, state, opts)...)
+	plan.Steps = append(plan.Steps, steps...)
+	plan.Drift = append(plan.Drift, tablespaceDrift(config.Tablespaces, state)...)
+	plan.Drift = append(plan.Drift, databasePropertyDrift(config.Databases, state)...)
+	if apply {
+		if err := execSteps(ctx, conn, steps); err != nil {
+			return nil, err
+		}
+	}
 
-			slog.Info("Creating schema", "name", schema.Name, "owner", schema.Owner)
-			// Execute the CREATE SCHEMA command
-			_, err = conn.Exec(ctx, createCmd)
-			if err != nil {
-				return fmt.Errorf("failed to create schema %s: %w", schema.Name, err)
+	// 2. Extensions and schemas within each database
+	for _, db := range config.Databases {
+		if db.AllowConnections != nil && !*db.AllowConnections {
+			if len(db.Extensions) > 0 || len(db.Schemas) > 0 {
+				slog.Warn("Skipping extensions and schemas of a database that doesn't allow connections", "database", db.Name)
 			}
-			slog.Info("Created schema", "name", schema.Name)
-		} else {
-			slog.Info("Schema already exists", "name", schema.Name)
+			continue
 		}
+		slog.Info("Processing database", "database", db.Name)
+		steps, drift, err := planDatabase(ctx, dbURL, db, state, managed, opts, apply)
+		if err != nil {
+			return nil, err
+		}
+		plan.Steps = append(plan.Steps, steps...)
+		plan.Drift = append(plan.Drift, drift...)
+	}
 
-		// Apply grants
-		for _, grant := range schema.Grants {
-			// Determine grantee (user or role)
-			var grantee string
-			var granteeType string
-			
-			if grant.User != "" {
-				grantee = grant.User
-				granteeType = "user"
-			} else if grant.Role != "" {
-				grantee = grant.Role
-				granteeType = "role"
-			} else {
-				return fmt.Errorf("schema grant must specify either user or role")
-			}
-			
-			// Apply schema privileges
-			if len(grant.Privileges) > 0 {
-				privileges := strings.Join(grant.Privileges, ", ")
-				grantCmd := fmt.Sprintf("GRANT %s ON SCHEMA %s TO %s", privileges, schema.Name, grantee)
-				slog.Info("Applying schema grant", "schema", schema.Name, granteeType, grantee, "privileges", privileges)
-				_, err = conn.Exec(ctx, grantCmd)
-				if err != nil {
-					return fmt.Errorf("failed to grant privileges on schema %s to %s: %w", schema.Name, grantee, err)
-				}
-			}
-			
-			// Apply table privileges if specified
-			if len(grant.TablePrivileges) > 0 {
-				tablePrivileges := strings.Join(grant.TablePrivileges, ", ")
-				tableGrantCmd := fmt.Sprintf("GRANT %s ON ALL TABLES IN SCHEMA %s TO %s", tablePrivileges, schema.Name, grantee)
-				slog.Info("Applying table grants", "schema", schema.Name, granteeType, grantee, "table_privileges", tablePrivileges)
-				_, err = conn.Exec(ctx, tableGrantCmd)
-				if err != nil {
-					return fmt.Errorf("failed to grant privileges on tables in schema %s to %s: %w", schema.Name, grantee, err)
-				}
-			}
-			
-			// Apply sequence privileges if specified
-			if len(grant.SequencePrivileges) > 0 {
-				seqPrivileges := strings.Join(grant.SequencePrivileges, ", ")
-				seqGrantCmd := fmt.Sprintf("GRANT %s ON ALL SEQUENCES IN SCHEMA %s TO %s", seqPrivileges, schema.Name, grantee)
-				slog.Info("Applying sequence grants", "schema", schema.Name, granteeType, grantee, "sequence_privileges", seqPrivileges)
-				_, err = conn.Exec(ctx, seqGrantCmd)
-				if err != nil {
-					return fmt.Errorf("failed to grant privileges on sequences in schema %s to %s: %w", schema.Name, grantee, err)
-				}
+	// 3. Databases and roles removed from the configuration
+	if opts.Prune {
+		steps, dropped := planPruneDatabases(config, managed, state, opts)
+		steps = append(steps, planPruneRoles(config, managed, state, dropped, opts)...)
+		plan.Steps = append(plan.Steps, steps...)
+		if apply {
+			if err := execStepsIn(ctx, dbURL, conn, steps); err != nil {
+				return nil, err
 			}
-			
-			// Apply function privileges if specified
-			if len(grant.FunctionPrivileges) > 0 {
-				funcPrivileges := strings.Join(grant.FunctionPrivileges, ", ")
-				funcGrantCmd := fmt.Sprintf("GRANT %s ON ALL FUNCTIONS IN SCHEMA %s TO %s", funcPrivileges, schema.Name, grantee)
-				slog.Info("Applying function grants", "schema", schema.Name, granteeType, grantee, "function_privileges", funcPrivileges)
-				_, err = conn.Exec(ctx, funcGrantCmd)
-				if err != nil {
-					return fmt.Errorf("failed to grant privileges on functions in schema %s to %s: %w", schema.Name, grantee, err)
-				}
-			}
-			
-			// Apply default privileges for future objects if specified
-			if len(grant.DefaultPrivileges) > 0 {
-				defPrivileges := strings.Join(grant.DefaultPrivileges, ", ")
-				// Default privileges are set for objects created by the schema owner
-				defGrantCmd := fmt.Sprintf("ALTER DEFAULT PRIVILEGES FOR ROLE %s IN SCHEMA %s GRANT %s ON TABLES TO %s", 
-					schema.Owner, schema.Name, defPrivileges, grantee)
-				slog.Info("Applying default privileges", "schema", schema.Name, granteeType, grantee, "default_privileges", defPrivileges)
-				_, err = conn.Exec(ctx, defGrantCmd)
-				if err != nil {
-					return fmt.Errorf("failed to grant default privileges in schema %s to %s: %w", schema.Name, grantee, err)
-				}
+			if err := recordManaged(ctx, conn, remainingManaged(config, managed, dropped)); err != nil {
+				return nil, err
 			}
 		}
 	}
 
-	return nil
+	return plan, nil
 }
 
-// createExtensions creates extensions within a database
-func createExtensions(ctx context.Context, conn *pgx.Conn, extensions []string) error {
-	if len(extensions) == 0 {
-		return nil
+// planDatabase connects to a single database and plans its extensions and
+// schemas, dropping the managed ones that were removed when pruning, and
+// reports the drift the plan doesn't correct. When
+// apply is true, inspection and every statement run in one transaction, so a
+// failure leaves the database as it was before the run.
+func planDatabase(ctx context.Context, dbURL string, db Database, state *clusterState, managed managedSet, opts Options, apply bool) ([]Step, []string, error) {
+	if _, exists := state.databases[db.Name]; !exists && !apply {
+		steps, err := planDatabaseSteps(db, newDatabaseCatalog(), managed, opts)
+		return steps, nil, err
 	}
 
-	// Create each extension
-	for _, extension := range extensions {
-		// Check if extension exists
-		var exists bool
-		err := conn.QueryRow(ctx, "SELECT EXISTS(SELECT 1 FROM pg_extension WHERE extname = $1)", extension).Scan(&exists)
-		if err != nil {
-			return fmt.Errorf("failed to check if extension exists: %w", err)
+	conn, err := connect(ctx, dbURL, db.Name, !apply)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close(ctx)
+
+	schemaNames := make([]string, 0, len(db.Schemas))
+	for _, schema := range db.Schemas {
+		schemaNames = append(schemaNames, schema.Name)
+	}
+	schemaNames = append(schemaNames, managed.schemaNames(db.Name)...)
+
+	steps, drift, err := planDatabaseTx(ctx, conn, db, schemaNames, managed, opts, apply)
+	if err != nil {
+		if apply {
+			return nil, nil, fmt.Errorf("rolled back changes to database %s: %w", db.Name, err)
 		}
+		return nil, nil, err
+	}
+	return steps, drift, nil
+}
 
-		if !exists {
-			// Build CREATE EXTENSION command
-			createCmd := fmt.Sprintf(`CREATE EXTENSION IF NOT EXISTS "%s"`, extension)
+// planDatabaseTx inspects and plans db in one transaction, and runs the steps
+// when applying. Checks and dry runs connect read-only, but their transaction
+// is opened read-write so that policy expressions can be deparsed on probe
+// policies; it is always rolled back.
+func planDatabaseTx(ctx context.Context, conn *pgx.Conn, db Database, schemaNames []string, managed managedSet, opts Options, apply bool) ([]Step, []string, error) {
+	txOptions := pgx.TxOptions{}
+	if !apply {
+		txOptions.AccessMode = pgx.ReadWrite
+	}
+	tx, err := conn.BeginTx(ctx, txOptions)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback(ctx)
 
-			slog.Info("Creating extension", "name", extension)
-			// Execute the CREATE EXTENSION command
-			_, err = conn.Exec(ctx, createCmd)
-			if err != nil {
-				return fmt.Errorf("failed to create extension %s: %w", extension, err)
-			}
-			slog.Info("Created extension", "name", extension)
+	catalog, err := inspectDatabase(ctx, tx, schemaNames)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := resolveFunctions(ctx, tx, db.Schemas, catalog); err != nil {
+		return nil, nil, err
+	}
+	if err := deparsePolicyExpressions(ctx, tx, db.Schemas, catalog); err != nil {
+		return nil, nil, err
+	}
+	steps, err := planDatabaseSteps(db, catalog, managed, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	drift := extensionDrift(db.Name, db.Extensions, catalog)
+	if !apply {
+		return steps, drift, nil
+	}
+	if err := execSteps(ctx, tx, steps); err != nil {
+		return nil, nil, err
+	}
+	return steps, drift, tx.Commit(ctx)
+}
+
+// planDatabaseSteps plans the statements for db against its catalog.
+// Extensions come first, except those installed in a schema the config
+// creates in this run, which follow the schemas.
+func planDatabaseSteps(db Database, catalog *databaseCatalog, managed managedSet, opts Options) ([]Step, error) {
+	var extensions, deferred []Extension
+	for _, extension := range db.Extensions {
+		if _, exists := catalog.schemas[extension.Schema]; extension.Schema != "" && !exists && db.declaresSchema(extension.Schema) {
+			deferred = append(deferred, extension)
 		} else {
-			slog.Info("Extension already exists", "name", extension)
+			extensions = append(extensions, extension)
 		}
 	}
 
-	return nil
+	steps := planExtensions(db.Name, extensions, catalog)
+	schemaSteps, err := planSchemas(db.Name, db.Schemas, catalog, opts)
+	if err != nil {
+		return nil, err
+	}
+	steps = append(steps, schemaSteps...)
+	steps = append(steps, planExtensions(db.Name, deferred, catalog)...)
+	if opts.Prune {
+		steps = append(steps, planPruneDatabaseObjects(db, managed, catalog)...)
+	}
+	return steps, nil
+}
+
+// Options controls how BootstrapDatabaseWithOptions applies a configuration
+type Options struct {
+	// Strict revokes privileges on managed databases and schemas, their
+	// objects and their default privileges that the configuration doesn't
+	// declare
+	Strict bool
+	// Prune drops roles, schemas and extensions dbstrap managed in an earlier
+	// pruning run that are no longer in the configuration
+	Prune bool
+	// PruneDatabases confirms that pruning may also drop databases
+	PruneDatabases bool
+	// ReassignTo receives the objects owned by pruned roles; empty means the
+	// connecting user
+	ReassignTo string
 }
 
+// BootstrapDatabase applies yamlData with options taken from the environment
 func BootstrapDatabase(yamlData []byte) error {
-	// Parse the YAML configuration
+	return BootstrapDatabaseWithOptions(yamlData, Options{
+		Strict:         getEnvBool("BOOTSTRAP_STRICT"),
+		Prune:          getEnvBool("BOOTSTRAP_PRUNE"),
+		PruneDatabases: getEnvBool("BOOTSTRAP_PRUNE_DATABASES"),
+		ReassignTo:     os.Getenv("BOOTSTRAP_REASSIGN_TO"),
+	})
+}
+
+// loadConfig parses yamlData and applies the settings that depend on the
+// whole configuration or the environment
+func loadConfig(yamlData []byte) (*Config, error) {
 	slog.Info("Parsing YAML configuration")
 	var config Config
 	if err := yaml.Unmarshal(yamlData, &config); err != nil {
-		return fmt.Errorf("failed to unmarshal yaml: %w", err)
+		return nil, fmt.Errorf("failed to unmarshal yaml: %w", err)
+	}
+
+	if err := resolveSchemaOwners(&config); err != nil {
+		return nil, err
 	}
 
-	// Set passwords from environment variables
-	slog.Info("Setting passwords from environment variables")
-	for i := range config.Users {
-		if config.Users[i].PasswordEnv != "" {
-			pw := os.Getenv(config.Users[i].PasswordEnv)
-			if pw == "" {
-				return fmt.Errorf("missing env var: %s for user %s", config.Users[i].PasswordEnv, config.Users[i].Name)
+	if getEnvBool("BOOTSTRAP_SYNC_PASSWORDS") {
+		for i := range config.Users {
+			if config.Users[i].SyncPassword == nil {
+				sync := true
+				config.Users[i].SyncPassword = &sync
 			}
-			config.Users[i].Password = pw
 		}
 	}
+	return &config, nil
+}
 
-	if outputPath := os.Getenv("BOOTSTRAP_OUTPUT_PATH"); outputPath != "" {
-		slog.Info("Output path specified but no longer used for SQL generation")
+// BootstrapDatabaseWithOptions applies yamlData to the cluster in DATABASE_URL
+func BootstrapDatabaseWithOptions(yamlData []byte, opts Options) error {
+	config, err := loadConfig(yamlData)
+	if err != nil {
+		return err
 	}
 
-	if getEnvBool("BOOTSTRAP_RENDER_ONLY") || getEnvBool("BOOTSTRAP_DRY_RUN") {
-		slog.Info("DRY RUN MODE - No changes will be made")
+	outputPath := os.Getenv("BOOTSTRAP_OUTPUT_PATH")
+	renderOnly := getEnvBool("BOOTSTRAP_RENDER_ONLY")
+	passwordVars := getEnvBool("BOOTSTRAP_PASSWORD_VARS")
+
+	// Passwords from environment variables are not needed when the rendered
+	// script reads them from psql variables and nothing is applied
+	if err := loadPasswords(config, true, renderOnly && passwordVars); err != nil {
+		return err
+	}
+
+	if outputPath != "" {
+		slog.Info("Rendering SQL script", "path", outputPath)
+		f, err := os.OpenFile(outputPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+		if err != nil {
+			return fmt.Errorf("failed to create output file: %w", err)
+		}
+		if err := renderSQL(f, config, passwordVars); err != nil {
+			f.Close()
+			return fmt.Errorf("failed to render SQL script: %w", err)
+		}
+		if err := f.Close(); err != nil {
+			return fmt.Errorf("failed to write output file: %w", err)
+		}
+	}
+
+	if renderOnly {
+		slog.Info("RENDER ONLY MODE - No changes will be made")
 		return nil
 	}
 
@@ -370,59 +779,21 @@ func BootstrapDatabase(yamlData []byte) error {
 
 	ctx := context.Background()
 
-	// 1. Create users first
-	slog.Info("Starting user creation")
-	if err := createUsers(ctx, dbURL, config.Users); err != nil {
-		return err
-	}
-
-	// 2. Create databases
-	if len(config.Databases) > 0 {
-		slog.Info("Starting database creation")
-		if err := createDatabases(ctx, dbURL, config.Databases); err != nil {
+	if getEnvBool("BOOTSTRAP_DRY_RUN") {
+		slog.Info("DRY RUN MODE - No changes will be made")
+		plan, err := runBootstrap(ctx, dbURL, config, opts, false)
+		if err != nil {
 			return err
 		}
+		return plan.Write(os.Stdout)
 	}
 
-	// 3. Create extensions and schemas within each database
-	for _, db := range config.Databases {
-		slog.Info("Processing database", "database", db.Name)
-
-		// Parse the original URL
-		dbConfig, err := pgx.ParseConfig(dbURL)
-		if err != nil {
-			return fmt.Errorf("failed to parse database URL: %w", err)
-		}
-
-		// Update the database name
-		dbConfig.Database = db.Name
-
-		// Connect to the specific database
-		slog.Info("Connecting to database", "database", db.Name)
-		conn, err := pgx.ConnectConfig(ctx, dbConfig)
-		if err != nil {
-			return fmt.Errorf("failed to connect to database %s: %w", db.Name, err)
-		}
-
-		// Create extensions for this database
-		if len(db.Extensions) > 0 {
-			slog.Info("Creating extensions", "database", db.Name, "extensions", db.Extensions)
-			if err := createExtensions(ctx, conn, db.Extensions); err != nil {
-				conn.Close(ctx)
-				return err
-			}
-		}
-
-		// Create schemas for this database
-		if len(db.Schemas) > 0 {
-			slog.Info("Creating schemas", "database", db.Name)
-			if err := createSchemas(ctx, conn, db.Schemas); err != nil {
-				conn.Close(ctx)
-				return err
-			}
-		}
-
-		conn.Close(ctx)
+	plan, err := runBootstrap(ctx, dbURL, config, opts, true)
+	if err != nil {
+		return err
+	}
+	for _, drift := range plan.Drift {
+		slog.Warn("Drift not corrected", "drift", drift)
 	}
 
 	slog.Info("Bootstrap executed successfully")
@@ -68,7 +68,7 @@ databases:
 	assert.Equal(t, "en_US.UTF-8", db.LcCollate)
 	assert.Equal(t, "en_US.UTF-8", db.LcCtype)
 	assert.Equal(t, "template0", db.Template)
-	assert.Contains(t, db.Extensions, "uuid-ossp")
+	assert.Contains(t, db.Extensions, Extension{Name: "uuid-ossp"})
 
 	// Verify grants
 	require.Len(t, db.Grants, 1)
@@ -98,3 +98,99 @@ databases:
 	assert.Contains(t, roleGrant.Privileges, "USAGE")
 	assert.Contains(t, roleGrant.TablePrivileges, "SELECT")
 }
+
+// TestParseRoleAttributes tests parsing of role attributes on users
+func TestParseRoleAttributes(t *testing.T) {
+	yamlData := []byte(`
+users:
+  - name: migrator
+    can_login: true
+    createdb: true
+    inherit: false
+    connection_limit: 10
+    valid_until: infinity
+`)
+
+	var config Config
+	require.NoError(t, parseConfig(yamlData, &config))
+	require.Len(t, config.Users, 1)
+
+	user := config.Users[0]
+	require.NotNil(t, user.CreateDB)
+	assert.True(t, *user.CreateDB)
+	require.NotNil(t, user.Inherit)
+	assert.False(t, *user.Inherit)
+	assert.Nil(t, user.Superuser)
+	require.NotNil(t, user.ConnectionLimit)
+	assert.Equal(t, 10, *user.ConnectionLimit)
+	assert.Equal(t, "infinity", user.ValidUntil)
+}
+
+// TestParseRoles tests parsing of the top-level group roles section
+func TestParseRoles(t *testing.T) {
+	yamlData := []byte(`
+roles:
+  - name: readonly_role
+  - name: readwrite_role
+    roles: [readonly_role]
+    connection_limit: 0
+users:
+  - name: app_user
+    can_login: true
+    roles: [readwrite_role]
+`)
+
+	var config Config
+	require.NoError(t, parseConfig(yamlData, &config))
+	require.Len(t, config.Roles, 2)
+	assert.Equal(t, "readonly_role", config.Roles[0].Name)
+	assert.Equal(t, []string{"readonly_role"}, config.Roles[1].Roles)
+	require.NotNil(t, config.Roles[1].ConnectionLimit)
+	assert.Equal(t, 0, *config.Roles[1].ConnectionLimit)
+	assert.Equal(t, []string{"readwrite_role"}, config.Users[0].Roles)
+}
+
+// TestResolveSchemaOwners tests that owns_schemas sets schema owners and
+// reports conflicts with Schema.Owner
+func TestResolveSchemaOwners(t *testing.T) {
+	yamlData := []byte(`
+users:
+  - name: app_user
+    owns_schemas: [app, public]
+databases:
+  - name: db1
+    schemas:
+      - name: app
+      - name: public
+        owner: app_user
+  - name: db2
+    schemas:
+      - name: app
+      - name: other
+`)
+
+	var config Config
+	require.NoError(t, parseConfig(yamlData, &config))
+	require.NoError(t, resolveSchemaOwners(&config))
+
+	for _, schema := range []Schema{config.Databases[0].Schemas[0], config.Databases[0].Schemas[1], config.Databases[1].Schemas[0]} {
+		assert.Equal(t, "app_user", schema.Owner, schema.Name)
+	}
+	assert.Empty(t, config.Databases[1].Schemas[1].Owner)
+
+	conflicting := []byte(`
+users:
+  - name: app_user
+    owns_schemas: [app]
+databases:
+  - name: db1
+    schemas:
+      - name: app
+        owner: someone_else
+`)
+	config = Config{}
+	require.NoError(t, parseConfig(conflicting, &config))
+	err := resolveSchemaOwners(&config)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "owner someone_else conflicts with owns_schemas of user app_user")
+}
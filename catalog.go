@@ -0,0 +1,826 @@
+package dbstrap
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// objectKind identifies the class of object a privilege applies to
+type objectKind string
+
+const (
+	kindDatabase objectKind = "database"
+	kindSchema   objectKind = "schema"
+	kindTable    objectKind = "table"
+	kindSequence objectKind = "sequence"
+	kindFunction objectKind = "function"
+	kindType     objectKind = "type"
+	kindColumn   objectKind = "column"
+
+	kindTablespace objectKind = "tablespace"
+)
+
+// canonicalGrantee spells the PUBLIC pseudo-role the way aclexplode reports it
+func canonicalGrantee(grantee string) string {
+	if strings.EqualFold(grantee, "public") {
+		return "PUBLIC"
+	}
+	return grantee
+}
+
+// aclSet maps a grantee to the privileges it holds on a single object
+type aclSet map[string]map[string]bool
+
+func (a aclSet) add(grantee, privilege string) {
+	grantee = canonicalGrantee(grantee)
+	if a[grantee] == nil {
+		a[grantee] = map[string]bool{}
+	}
+	a[grantee][privilege] = true
+}
+
+// declare adds privileges for grantee
+func (a aclSet) declare(grantee string, privileges []string) {
+	for _, p := range privileges {
+		a.add(grantee, p)
+	}
+}
+
+// has reports whether grantee holds every one of the given privileges
+func (a aclSet) has(grantee string, privileges []string) bool {
+	grantee = canonicalGrantee(grantee)
+	for _, p := range privileges {
+		if !a[grantee][p] {
+			return false
+		}
+	}
+	return true
+}
+
+type roleState struct {
+	canLogin    bool
+	superuser   bool
+	createDB    bool
+	createRole  bool
+	replication bool
+	bypassRLS   bool
+	inherit     bool
+	connLimit   int
+	// validUntil is "" when unset, "infinity", or RFC 3339 in UTC
+	validUntil string
+	memberOf   map[string]bool
+	// password is the verifier from pg_authid; passwordKnown is false when the
+	// connecting role may not read pg_authid
+	password      string
+	passwordKnown bool
+	// system is set for roles created by initdb
+	system bool
+}
+
+type databaseState struct {
+	owner     string
+	encoding  string
+	collate   string
+	ctype     string
+	allowConn bool
+	acl       aclSet
+	// system is set for databases created by initdb
+	system           bool
+	connLimit        int
+	tablespace       string
+	isTemplate       bool
+	localeProvider   string
+	icuLocale        string
+	collationVersion string
+}
+
+// clusterState is a snapshot of the cluster-wide catalogs dbstrap manages
+type clusterState struct {
+	roles       map[string]*roleState
+	databases   map[string]*databaseState
+	tablespaces map[string]*tablespaceState
+	// settings holds pg_db_role_setting, mapping parameter names to the
+	// values as PostgreSQL stores them
+	settings map[settingKey]map[string]string
+}
+
+type tablespaceState struct {
+	owner    string
+	location string
+	options  map[string]string
+	acl      aclSet
+	// system is set for pg_default and pg_global
+	system bool
+}
+
+// settingKey identifies a pg_db_role_setting entry; an empty role or database
+// applies to all of them
+type settingKey struct {
+	role     string
+	database string
+}
+
+type schemaState struct {
+	owner string
+	acl   aclSet
+	// objects holds every existing table, sequence and function in the
+	// schema, keyed by kind and then by name; function names include their
+	// argument types
+	objects map[objectKind]map[string]*objectState
+}
+
+type objectState struct {
+	owner string
+	// args is the identity argument list of a function, empty otherwise
+	args string
+	acl  aclSet
+	// relkind is the pg_class kind of tables and sequences
+	relkind string
+	// linked is set for sequences that belong to a table column; their owner
+	// follows the table's
+	linked bool
+	// extension is set for objects that belong to an extension, which
+	// manages their privileges and owner
+	extension bool
+	// columns holds the column privileges of a table, keyed by column name
+	columns map[string]aclSet
+	// rowSecurity and forceRowSecurity are the row-level security flags of
+	// a table, whose policies are keyed by name
+	rowSecurity      bool
+	forceRowSecurity bool
+	policies         map[string]*policyState
+}
+
+type policyState struct {
+	command     string
+	restrictive bool
+	// roles are canonical role names, sorted
+	roles     []string
+	using     string
+	withCheck string
+}
+
+type extensionState struct {
+	version string
+	schema  string
+}
+
+// defaultACLKey identifies a pg_default_acl entry
+type defaultACLKey struct {
+	forRole string
+	schema  string
+	kind    objectKind
+}
+
+// databaseCatalog is a snapshot of the per-database catalogs dbstrap manages
+type databaseCatalog struct {
+	extensions  map[string]*extensionState
+	schemas     map[string]*schemaState
+	defaultACLs map[defaultACLKey]aclSet
+	// expressions are configured policy expressions as the server deparses
+	// them on their table, comparable with pg_policies
+	expressions map[expressionKey]string
+	// functions maps configured function signatures to the catalog key of
+	// the function the server resolves them to
+	functions map[functionKey]string
+	// currentUser is the connecting user, who owns the schemas it creates
+	currentUser string
+}
+
+// functionKey identifies a function signature as the config writes it
+type functionKey struct {
+	schema, name, args string
+}
+
+// expressionKey identifies a configured policy expression on a table
+type expressionKey struct {
+	schema, table, expr string
+}
+
+func newClusterState() *clusterState {
+	return &clusterState{
+		roles:       map[string]*roleState{},
+		databases:   map[string]*databaseState{},
+		tablespaces: map[string]*tablespaceState{},
+		settings:    map[settingKey]map[string]string{},
+	}
+}
+
+func newDatabaseCatalog() *databaseCatalog {
+	return &databaseCatalog{
+		extensions:  map[string]*extensionState{},
+		schemas:     map[string]*schemaState{},
+		defaultACLs: map[defaultACLKey]aclSet{},
+		expressions: map[expressionKey]string{},
+		functions:   map[functionKey]string{},
+	}
+}
+
+// querier is the subset of pgx.Conn and pgx.Tx used to read catalogs
+type querier interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}
+
+// firstNormalOID is the first oid assigned to objects created after initdb
+const firstNormalOID = "16384"
+
+// granteeExpr renders an aclexplode grantee oid as a role name
+const granteeExpr = "CASE WHEN a.grantee = 0 THEN 'PUBLIC' ELSE pg_get_userbyid(a.grantee) END"
+
+// inspectCluster reads roles, memberships, databases, tablespaces and settings
+// from pg_roles, pg_auth_members, pg_database, pg_tablespace and
+// pg_db_role_setting
+func inspectCluster(ctx context.Context, q querier) (*clusterState, error) {
+	state := newClusterState()
+
+	rows, err := q.Query(ctx, `SELECT rolname, rolcanlogin, rolsuper, rolcreatedb, rolcreaterole,
+		rolreplication, rolbypassrls, rolinherit, rolconnlimit, rolvaliduntil, oid < `+firstNormalOID+`
+		FROM pg_roles`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read roles: %w", err)
+	}
+	for rows.Next() {
+		var name string
+		var validUntil pgtype.Timestamptz
+		role := &roleState{memberOf: map[string]bool{}}
+		if err := rows.Scan(&name, &role.canLogin, &role.superuser, &role.createDB, &role.createRole,
+			&role.replication, &role.bypassRLS, &role.inherit, &role.connLimit, &validUntil, &role.system); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to read roles: %w", err)
+		}
+		switch {
+		case !validUntil.Valid:
+		case validUntil.InfinityModifier == pgtype.Infinity:
+			role.validUntil = "infinity"
+		default:
+			role.validUntil = validUntil.Time.UTC().Format(time.RFC3339)
+		}
+		state.roles[name] = role
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read roles: %w", err)
+	}
+
+	// pg_authid is only readable by superusers; without it passwords are
+	// treated as unknown
+	var canReadAuthid bool
+	rows, err = q.Query(ctx, "SELECT has_table_privilege('pg_catalog.pg_authid', 'SELECT')")
+	if err != nil {
+		return nil, fmt.Errorf("failed to check pg_authid access: %w", err)
+	}
+	for rows.Next() {
+		if err := rows.Scan(&canReadAuthid); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to check pg_authid access: %w", err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to check pg_authid access: %w", err)
+	}
+	if canReadAuthid {
+		rows, err = q.Query(ctx, "SELECT rolname, coalesce(rolpassword, '') FROM pg_authid")
+		if err != nil {
+			return nil, fmt.Errorf("failed to read role passwords: %w", err)
+		}
+		for rows.Next() {
+			var name, password string
+			if err := rows.Scan(&name, &password); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to read role passwords: %w", err)
+			}
+			if r, ok := state.roles[name]; ok {
+				r.password = password
+				r.passwordKnown = true
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read role passwords: %w", err)
+		}
+	}
+
+	rows, err = q.Query(ctx, `SELECT m.rolname, r.rolname
+		FROM pg_auth_members am
+		JOIN pg_roles r ON r.oid = am.roleid
+		JOIN pg_roles m ON m.oid = am.member`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read role memberships: %w", err)
+	}
+	for rows.Next() {
+		var member, role string
+		if err := rows.Scan(&member, &role); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to read role memberships: %w", err)
+		}
+		if r, ok := state.roles[member]; ok {
+			r.memberOf[role] = true
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read role memberships: %w", err)
+	}
+
+	// The locale provider columns were added in PostgreSQL 15 and
+	// daticulocale became datlocale in 17, so they are read through jsonb
+	rows, err = q.Query(ctx, `SELECT d.datname, pg_get_userbyid(d.datdba), pg_encoding_to_char(d.encoding),
+		d.datcollate, d.datctype, d.datallowconn, d.oid < `+firstNormalOID+`,
+		d.datconnlimit, t.spcname, d.datistemplate,
+		CASE to_jsonb(d) ->> 'datlocprovider' WHEN 'i' THEN 'icu' WHEN 'b' THEN 'builtin' ELSE 'libc' END,
+		coalesce(to_jsonb(d) ->> 'datlocale', to_jsonb(d) ->> 'daticulocale', ''),
+		coalesce(to_jsonb(d) ->> 'datcollversion', '')
+		FROM pg_database d
+		JOIN pg_tablespace t ON t.oid = d.dattablespace`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read databases: %w", err)
+	}
+	for rows.Next() {
+		var name string
+		db := &databaseState{acl: aclSet{}}
+		if err := rows.Scan(&name, &db.owner, &db.encoding, &db.collate, &db.ctype, &db.allowConn, &db.system,
+			&db.connLimit, &db.tablespace, &db.isTemplate, &db.localeProvider, &db.icuLocale, &db.collationVersion); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to read databases: %w", err)
+		}
+		state.databases[name] = db
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read databases: %w", err)
+	}
+
+	rows, err = q.Query(ctx, `SELECT d.datname, `+granteeExpr+`, a.privilege_type
+		FROM pg_database d, aclexplode(coalesce(d.datacl, acldefault('d', d.datdba))) a`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read database privileges: %w", err)
+	}
+	for rows.Next() {
+		var name, grantee, privilege string
+		if err := rows.Scan(&name, &grantee, &privilege); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to read database privileges: %w", err)
+		}
+		if db, ok := state.databases[name]; ok {
+			db.acl.add(grantee, privilege)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read database privileges: %w", err)
+	}
+
+	rows, err = q.Query(ctx, `SELECT spcname, pg_get_userbyid(spcowner), pg_tablespace_location(oid),
+		coalesce(spcoptions, '{}'), oid < `+firstNormalOID+`
+		FROM pg_tablespace`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tablespaces: %w", err)
+	}
+	for rows.Next() {
+		var name string
+		var options []string
+		tablespace := &tablespaceState{options: map[string]string{}, acl: aclSet{}}
+		if err := rows.Scan(&name, &tablespace.owner, &tablespace.location, &options, &tablespace.system); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to read tablespaces: %w", err)
+		}
+		for _, option := range options {
+			if key, value, ok := strings.Cut(option, "="); ok {
+				tablespace.options[key] = value
+			}
+		}
+		state.tablespaces[name] = tablespace
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read tablespaces: %w", err)
+	}
+
+	rows, err = q.Query(ctx, `SELECT t.spcname, `+granteeExpr+`, a.privilege_type
+		FROM pg_tablespace t, aclexplode(coalesce(t.spcacl, acldefault('t', t.spcowner))) a`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tablespace privileges: %w", err)
+	}
+	for rows.Next() {
+		var name, grantee, privilege string
+		if err := rows.Scan(&name, &grantee, &privilege); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to read tablespace privileges: %w", err)
+		}
+		if tablespace, ok := state.tablespaces[name]; ok {
+			tablespace.acl.add(grantee, privilege)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read tablespace privileges: %w", err)
+	}
+
+	rows, err = q.Query(ctx, `SELECT coalesce(r.rolname, ''), coalesce(d.datname, ''), s.setconfig
+		FROM pg_db_role_setting s
+		LEFT JOIN pg_roles r ON r.oid = s.setrole
+		LEFT JOIN pg_database d ON d.oid = s.setdatabase`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read settings: %w", err)
+	}
+	for rows.Next() {
+		var key settingKey
+		var config []string
+		if err := rows.Scan(&key.role, &key.database, &config); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to read settings: %w", err)
+		}
+		state.settings[key] = parseSettings(config)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read settings: %w", err)
+	}
+
+	return state, nil
+}
+
+// parseSettings turns a setconfig array into parameter values keyed by
+// lowercase name. PostgreSQL stores the canonical spelling, such as TimeZone,
+// while the config and SET are case-insensitive.
+func parseSettings(config []string) map[string]string {
+	settings := map[string]string{}
+	for _, entry := range config {
+		if name, value, ok := strings.Cut(entry, "="); ok {
+			settings[strings.ToLower(name)] = value
+		}
+	}
+	return settings
+}
+
+// inspectAvailableExtensions reads the versions of every extension installed
+// on the server, keyed by extension name
+func inspectAvailableExtensions(ctx context.Context, q querier) (map[string]map[string]bool, error) {
+	rows, err := q.Query(ctx, "SELECT name, version FROM pg_available_extension_versions")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read available extensions: %w", err)
+	}
+	available := map[string]map[string]bool{}
+	for rows.Next() {
+		var name, version string
+		if err := rows.Scan(&name, &version); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to read available extensions: %w", err)
+		}
+		if available[name] == nil {
+			available[name] = map[string]bool{}
+		}
+		available[name][version] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read available extensions: %w", err)
+	}
+	return available, nil
+}
+
+// inspectDatabase reads extensions, the given schemas, the objects inside them
+// and default privileges from the database q is connected to
+func inspectDatabase(ctx context.Context, q querier, schemas []string) (*databaseCatalog, error) {
+	catalog := newDatabaseCatalog()
+
+	rows, err := q.Query(ctx, `SELECT current_user`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read current user: %w", err)
+	}
+	if catalog.currentUser, err = pgx.CollectOneRow(rows, pgx.RowTo[string]); err != nil {
+		return nil, fmt.Errorf("failed to read current user: %w", err)
+	}
+
+	rows, err = q.Query(ctx, `SELECT e.extname, e.extversion, n.nspname
+		FROM pg_extension e
+		JOIN pg_namespace n ON n.oid = e.extnamespace`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read extensions: %w", err)
+	}
+	for rows.Next() {
+		var name string
+		extension := &extensionState{}
+		if err := rows.Scan(&name, &extension.version, &extension.schema); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to read extensions: %w", err)
+		}
+		catalog.extensions[name] = extension
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read extensions: %w", err)
+	}
+
+	rows, err = q.Query(ctx, `SELECT n.nspname, pg_get_userbyid(n.nspowner), `+granteeExpr+`, a.privilege_type
+		FROM pg_namespace n, aclexplode(coalesce(n.nspacl, acldefault('n', n.nspowner))) a
+		WHERE n.nspname = ANY($1)`, schemas)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schemas: %w", err)
+	}
+	for rows.Next() {
+		var name, owner, grantee, privilege string
+		if err := rows.Scan(&name, &owner, &grantee, &privilege); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to read schemas: %w", err)
+		}
+		schema := catalog.schemas[name]
+		if schema == nil {
+			schema = &schemaState{owner: owner, acl: aclSet{}, objects: map[objectKind]map[string]*objectState{}}
+			catalog.schemas[name] = schema
+		}
+		schema.acl.add(grantee, privilege)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read schemas: %w", err)
+	}
+
+	// Tables cover everything GRANT ... ON ALL TABLES reaches: tables, views,
+	// materialized views, foreign and partitioned tables
+	rows, err = q.Query(ctx, `SELECT n.nspname,
+			CASE WHEN c.relkind = 'S' THEN 'sequence' ELSE 'table' END,
+			c.relname, '', pg_get_userbyid(c.relowner), c.relkind::text,
+			EXISTS (SELECT 1 FROM pg_depend d
+				WHERE d.classid = 'pg_class'::regclass AND d.objid = c.oid
+				AND d.refclassid = 'pg_class'::regclass AND d.deptype IN ('a', 'i')),
+			EXISTS (SELECT 1 FROM pg_depend d
+				WHERE d.classid = 'pg_class'::regclass AND d.objid = c.oid AND d.deptype = 'e'),
+			`+granteeExpr+`, a.privilege_type
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace,
+		aclexplode(coalesce(c.relacl, acldefault((CASE WHEN c.relkind = 'S' THEN 's' ELSE 'r' END)::"char", c.relowner))) a
+		WHERE c.relkind IN ('r', 'p', 'v', 'm', 'f', 'S') AND n.nspname = ANY($1)
+		UNION ALL
+		SELECT n.nspname, 'function',
+			p.proname, pg_get_function_identity_arguments(p.oid), pg_get_userbyid(p.proowner), '', false,
+			EXISTS (SELECT 1 FROM pg_depend d
+				WHERE d.classid = 'pg_proc'::regclass AND d.objid = p.oid AND d.deptype = 'e'),
+			`+granteeExpr+`, a.privilege_type
+		FROM pg_proc p
+		JOIN pg_namespace n ON n.oid = p.pronamespace,
+		aclexplode(coalesce(p.proacl, acldefault('f', p.proowner))) a
+		WHERE p.prokind IN ('f', 'a', 'w') AND n.nspname = ANY($1)`, schemas)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read object privileges: %w", err)
+	}
+	for rows.Next() {
+		var schemaName, kind, name, args, owner, relkind, grantee, privilege string
+		var linked, extension bool
+		if err := rows.Scan(&schemaName, &kind, &name, &args, &owner, &relkind, &linked, &extension, &grantee, &privilege); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to read object privileges: %w", err)
+		}
+		schema := catalog.schemas[schemaName]
+		if schema == nil {
+			continue
+		}
+		objects := schema.objects[objectKind(kind)]
+		if objects == nil {
+			objects = map[string]*objectState{}
+			schema.objects[objectKind(kind)] = objects
+		}
+		key := name
+		if objectKind(kind) == kindFunction {
+			key = name + "(" + args + ")"
+		}
+		if objects[key] == nil {
+			objects[key] = &objectState{owner: owner, args: args, relkind: relkind, linked: linked, extension: extension, acl: aclSet{}}
+		}
+		objects[key].acl.add(grantee, privilege)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read object privileges: %w", err)
+	}
+
+	rows, err = q.Query(ctx, `SELECT n.nspname, c.relname, c.relrowsecurity, c.relforcerowsecurity
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind IN ('r', 'p') AND n.nspname = ANY($1)`, schemas)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read row security: %w", err)
+	}
+	for rows.Next() {
+		var schemaName, table string
+		var enabled, forced bool
+		if err := rows.Scan(&schemaName, &table, &enabled, &forced); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to read row security: %w", err)
+		}
+		if schema := catalog.schemas[schemaName]; schema != nil && schema.objects[kindTable][table] != nil {
+			schema.objects[kindTable][table].rowSecurity = enabled
+			schema.objects[kindTable][table].forceRowSecurity = forced
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read row security: %w", err)
+	}
+
+	rows, err = q.Query(ctx, `SELECT schemaname, tablename, policyname, permissive = 'RESTRICTIVE', cmd,
+			roles::text[], coalesce(qual, ''), coalesce(with_check, '')
+		FROM pg_policies
+		WHERE schemaname = ANY($1)`, schemas)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policies: %w", err)
+	}
+	for rows.Next() {
+		var schemaName, table, name string
+		policy := &policyState{}
+		if err := rows.Scan(&schemaName, &table, &name, &policy.restrictive, &policy.command,
+			&policy.roles, &policy.using, &policy.withCheck); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to read policies: %w", err)
+		}
+		schema := catalog.schemas[schemaName]
+		if schema == nil || schema.objects[kindTable][table] == nil {
+			continue
+		}
+		for i, role := range policy.roles {
+			policy.roles[i] = canonicalGrantee(role)
+		}
+		sort.Strings(policy.roles)
+		object := schema.objects[kindTable][table]
+		if object.policies == nil {
+			object.policies = map[string]*policyState{}
+		}
+		object.policies[name] = policy
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read policies: %w", err)
+	}
+
+	rows, err = q.Query(ctx, `SELECT n.nspname, c.relname, att.attname, `+granteeExpr+`, a.privilege_type
+		FROM pg_attribute att
+		JOIN pg_class c ON c.oid = att.attrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace,
+		aclexplode(att.attacl) a
+		WHERE att.attacl IS NOT NULL AND att.attnum > 0 AND NOT att.attisdropped
+		AND c.relkind IN ('r', 'p', 'v', 'm', 'f') AND n.nspname = ANY($1)`, schemas)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read column privileges: %w", err)
+	}
+	for rows.Next() {
+		var schemaName, table, column, grantee, privilege string
+		if err := rows.Scan(&schemaName, &table, &column, &grantee, &privilege); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to read column privileges: %w", err)
+		}
+		schema := catalog.schemas[schemaName]
+		if schema == nil || schema.objects[kindTable][table] == nil {
+			continue
+		}
+		object := schema.objects[kindTable][table]
+		if object.columns == nil {
+			object.columns = map[string]aclSet{}
+		}
+		if object.columns[column] == nil {
+			object.columns[column] = aclSet{}
+		}
+		object.columns[column].add(grantee, privilege)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read column privileges: %w", err)
+	}
+
+	rows, err = q.Query(ctx, `SELECT pg_get_userbyid(d.defaclrole), coalesce(n.nspname, ''),
+			d.defaclobjtype::text, `+granteeExpr+`, a.privilege_type
+		FROM pg_default_acl d
+		LEFT JOIN pg_namespace n ON n.oid = d.defaclnamespace,
+		aclexplode(d.defaclacl) a`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read default privileges: %w", err)
+	}
+	for rows.Next() {
+		var key defaultACLKey
+		var objType, grantee, privilege string
+		if err := rows.Scan(&key.forRole, &key.schema, &objType, &grantee, &privilege); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to read default privileges: %w", err)
+		}
+		kind, ok := defaultACLKinds[objType]
+		if !ok {
+			continue
+		}
+		key.kind = kind
+		if catalog.defaultACLs[key] == nil {
+			catalog.defaultACLs[key] = aclSet{}
+		}
+		catalog.defaultACLs[key].add(grantee, privilege)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read default privileges: %w", err)
+	}
+
+	return catalog, nil
+}
+
+// defaultACLKinds maps pg_default_acl.defaclobjtype to object kinds
+var defaultACLKinds = map[string]objectKind{
+	"r": kindTable,
+	"S": kindSequence,
+	"f": kindFunction,
+	"T": kindType,
+}
+
+// deparsePolicyExpressions has the server deparse the configured expressions
+// of existing policies, so they compare with pg_policies however they are
+// written. Each expression is attached to a throwaway policy under a
+// savepoint that is rolled back. Expressions the server rejects are left
+// out, and their policies are altered.
+func deparsePolicyExpressions(ctx context.Context, tx pgx.Tx, schemas []Schema, catalog *databaseCatalog) error {
+	for _, schema := range schemas {
+		current := catalog.schemas[schema.Name]
+		if current == nil {
+			continue
+		}
+		for _, rls := range schema.RowSecurity {
+			table := current.objects[kindTable][rls.Table]
+			if table == nil {
+				continue
+			}
+			for _, policy := range rls.Policies {
+				if table.policies[policy.Name] == nil {
+					continue
+				}
+				for _, expr := range []string{policy.Using, policy.WithCheck} {
+					key := expressionKey{schema.Name, rls.Table, expr}
+					if _, done := catalog.expressions[key]; expr == "" || done {
+						continue
+					}
+					deparsed, ok, err := deparseExpression(ctx, tx, quoteIdent(schema.Name)+"."+quoteIdent(rls.Table), expr)
+					if err != nil {
+						return fmt.Errorf("failed to deparse policy %s on %s.%s: %w", policy.Name, schema.Name, rls.Table, err)
+					}
+					if ok {
+						catalog.expressions[key] = deparsed
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// deparseExpression returns expr as pg_get_expr prints it for table. It
+// reports false when the server rejects the expression.
+func deparseExpression(ctx context.Context, tx pgx.Tx, table, expr string) (string, bool, error) {
+	probe, err := tx.Begin(ctx)
+	if err != nil {
+		return "", false, err
+	}
+	var deparsed string
+	_, err = probe.Exec(ctx, "CREATE POLICY dbstrap_probe ON "+table+" USING ("+expr+")")
+	if err == nil {
+		err = probe.QueryRow(ctx, `SELECT pg_get_expr(polqual, polrelid) FROM pg_policy
+			WHERE polname = 'dbstrap_probe' AND polrelid = $1::regclass`, table).Scan(&deparsed)
+	}
+	if rbErr := probe.Rollback(ctx); rbErr != nil {
+		return "", false, rbErr
+	}
+	return deparsed, err == nil, nil
+}
+
+// resolveFunctions has the server resolve the signatures of functions named
+// in object grants, so that int and integer, or spacing, match the same
+// function. A signature that matches none of the existing functions of that
+// name is an error; functions that don't exist yet are left to a later run.
+func resolveFunctions(ctx context.Context, q querier, schemas []Schema, catalog *databaseCatalog) error {
+	for _, schema := range schemas {
+		current := catalog.schemas[schema.Name]
+		if current == nil {
+			continue
+		}
+		for _, grant := range schema.Grants {
+			for _, object := range grant.Objects {
+				if kind, err := object.kind(); err != nil || kind != kindFunction {
+					continue
+				}
+				key := functionKey{schema.Name, object.Name, object.Args}
+				if _, done := catalog.functions[key]; done {
+					continue
+				}
+
+				signature := quoteIdent(schema.Name) + "." + quoteIdent(object.Name) + "(" + object.Args + ")"
+				rows, err := q.Query(ctx, `SELECT p.proname || '(' || pg_get_function_identity_arguments(p.oid) || ')'
+					FROM pg_proc p WHERE p.oid = to_regprocedure($1)`, signature)
+				if err != nil {
+					return fmt.Errorf("failed to resolve function %s.%s(%s): %w", schema.Name, object.Name, object.Args, err)
+				}
+				resolved, err := pgx.CollectRows(rows, pgx.RowTo[string])
+				if err != nil {
+					return fmt.Errorf("failed to resolve function %s.%s(%s): %w", schema.Name, object.Name, object.Args, err)
+				}
+				if len(resolved) == 1 {
+					catalog.functions[key] = resolved[0]
+					continue
+				}
+
+				var overloads []string
+				for _, name := range sortedKeys(current.objects[kindFunction]) {
+					if strings.HasPrefix(name, object.Name+"(") {
+						overloads = append(overloads, name)
+					}
+				}
+				if len(overloads) > 0 {
+					return fmt.Errorf("function %s.%s(%s) matches none of %s", schema.Name, object.Name, object.Args, strings.Join(overloads, ", "))
+				}
+			}
+		}
+	}
+	return nil
+}
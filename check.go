@@ -0,0 +1,64 @@
+package dbstrap
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Check compares the cluster in DATABASE_URL with yamlData without changing
+// anything. It writes every difference to w, as the statement that would
+// correct it where there is one, and reports whether any was found.
+// Passwords are only compared for users whose password can be read.
+func Check(yamlData []byte, opts Options, w io.Writer) (bool, error) {
+	config, err := loadConfig(yamlData)
+	if err != nil {
+		return false, err
+	}
+	if err := loadPasswords(config, false, false); err != nil {
+		return false, err
+	}
+
+	dbURL := os.Getenv("DATABASE_URL")
+	if dbURL == "" {
+		return false, fmt.Errorf("DATABASE_URL must be set")
+	}
+
+	plan, err := runBootstrap(context.Background(), dbURL, config, opts, false)
+	if err != nil {
+		return false, err
+	}
+	return writeDrift(w, plan)
+}
+
+// writeDrift prints the steps of plan that change something and its drift,
+// and reports whether there were any. Unverified steps are listed as
+// unverifiable and don't count.
+func writeDrift(w io.Writer, plan *Plan) (bool, error) {
+	var changes, unverified []Step
+	for _, step := range plan.Changes() {
+		if step.Unverified {
+			unverified = append(unverified, step)
+		} else {
+			changes = append(changes, step)
+		}
+	}
+	differences := len(changes) + len(plan.Drift)
+	if differences > 0 {
+		if err := writeSteps(w, changes, plan.Drift); err != nil {
+			return true, err
+		}
+	}
+	for _, step := range unverified {
+		if _, err := fmt.Fprintf(w, "-- unverifiable: %s;\n", step); err != nil {
+			return differences > 0, err
+		}
+	}
+	if differences == 0 {
+		_, err := fmt.Fprintln(w, "No drift: the cluster matches the config.")
+		return false, err
+	}
+	_, err := fmt.Fprintf(w, "Drift: %d differences from the config.\n", differences)
+	return true, err
+}
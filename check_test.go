@@ -0,0 +1,93 @@
+package dbstrap
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestDatabasePropertyDrift tests that properties fixed at creation are
+// compared with the config
+func TestDatabasePropertyDrift(t *testing.T) {
+	state := newClusterState()
+	state.databases["app"] = &databaseState{owner: "app_user", encoding: "UTF8", collate: "en_US.utf8", ctype: "en_US.utf8",
+		localeProvider: "libc", collationVersion: "2.36", acl: aclSet{}}
+
+	drift := databasePropertyDrift([]Database{{
+		Name:             "app",
+		Encoding:         "utf-8",
+		LcCollate:        "en_US.UTF-8",
+		LcCtype:          "C",
+		LocaleProvider:   "icu",
+		IcuLocale:        "en-US",
+		CollationVersion: "2.36",
+	}}, state)
+	assert.Equal(t, []string{
+		"database app has lc_ctype en_US.utf8, not C",
+		"database app has locale_provider libc, not icu",
+		"database app has no icu_locale, not en-US",
+	}, drift)
+}
+
+// TestTablespaceDrift tests that a tablespace in another location is reported
+func TestTablespaceDrift(t *testing.T) {
+	state := newClusterState()
+	state.tablespaces["fast_ssd"] = &tablespaceState{owner: "postgres", location: "/mnt/ssd", acl: aclSet{}}
+
+	drift := tablespaceDrift([]Tablespace{
+		{Name: "fast_ssd", Location: "/mnt/nvme"},
+		{Name: "archive", Location: "/mnt/archive"},
+	}, state)
+	assert.Equal(t, []string{"tablespace fast_ssd is located in /mnt/ssd, not /mnt/nvme"}, drift)
+}
+
+// TestWriteDrift tests the check report
+func TestWriteDrift(t *testing.T) {
+	var out bytes.Buffer
+	drifted, err := writeDrift(&out, &Plan{Steps: []Step{{Action: ActionNoop, SQL: "CREATE ROLE app_user"}}})
+	require.NoError(t, err)
+	assert.False(t, drifted)
+	assert.Equal(t, "No drift: the cluster matches the config.\n", out.String())
+
+	out.Reset()
+	drifted, err = writeDrift(&out, &Plan{
+		Steps: []Step{
+			{Action: ActionNoop, SQL: "CREATE ROLE app_user"},
+			{Action: ActionCreate, SQL: "CREATE ROLE reader"},
+			{Action: ActionUpdate, Database: "app", SQL: "REVOKE CREATE ON SCHEMA app FROM reader"},
+		},
+		Drift: []string{"database app is owned by postgres, not app_user"},
+	})
+	require.NoError(t, err)
+	assert.True(t, drifted)
+	assert.Equal(t, `-- cluster
+create  CREATE ROLE reader;
+-- database app
+update  REVOKE CREATE ON SCHEMA app FROM reader;
+drift   database app is owned by postgres, not app_user
+Drift: 3 differences from the config.
+`, out.String())
+}
+
+// TestWriteDriftUnverified tests that passwords whose verifier can't be read
+// are listed but not counted as drift
+func TestWriteDriftUnverified(t *testing.T) {
+	sync := true
+	state := newClusterState()
+	state.roles["app_user"] = &roleState{canLogin: true, memberOf: map[string]bool{}, passwordKnown: false}
+	steps, err := planUsers([]User{{Name: "app_user", CanLogin: true, Password: "secret", SyncPassword: &sync}}, state)
+	require.NoError(t, err)
+	require.Len(t, steps, 2)
+	assert.Equal(t, ActionUpdate, steps[1].Action, "run still sets a password it can't compare")
+	assert.True(t, steps[1].Unverified)
+
+	var out bytes.Buffer
+	drifted, err := writeDrift(&out, &Plan{Steps: steps})
+	require.NoError(t, err)
+	assert.False(t, drifted)
+	assert.Equal(t, `-- unverifiable: ALTER ROLE app_user WITH PASSWORD '********';
+No drift: the cluster matches the config.
+`, out.String())
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"os"
 
@@ -10,8 +12,22 @@ import (
 
 var CLI struct {
 	Run struct {
-		Config string `help:"Path to YAML bootstrap config" default:"bootstrap.yaml"`
+		Config         string `help:"Path to YAML bootstrap config" default:"bootstrap.yaml"`
+		Strict         bool   `help:"Revoke privileges on managed databases and schemas that the config doesn't declare" env:"BOOTSTRAP_STRICT"`
+		Prune          bool   `help:"Drop roles, schemas and extensions removed from the config since the last pruning run" env:"BOOTSTRAP_PRUNE"`
+		PruneDatabases bool   `help:"Also drop databases removed from the config when pruning" env:"BOOTSTRAP_PRUNE_DATABASES"`
+		ReassignTo     string `help:"Role that receives objects owned by pruned roles (default: the connecting user)" env:"BOOTSTRAP_REASSIGN_TO"`
 	} `cmd:"" help:"Run the dbstrap process"`
+	Validate struct {
+		Config string `help:"Path to YAML bootstrap config" default:"bootstrap.yaml"`
+	} `cmd:"" help:"Check a config for errors without connecting to a database"`
+	Check struct {
+		Config string `help:"Path to YAML bootstrap config" default:"bootstrap.yaml"`
+		Strict bool   `help:"Also report privileges the config doesn't declare, as run --strict would revoke them" env:"BOOTSTRAP_STRICT"`
+	} `cmd:"" help:"Compare the cluster with a config without changing it; exits 2 on drift"`
+	Export struct {
+		Output string `short:"o" help:"Write the config to this file instead of stdout"`
+	} `cmd:"" help:"Write a config that reproduces the roles, databases and schemas of DATABASE_URL"`
 }
 
 func main() {
@@ -28,9 +44,64 @@ func main() {
 			log.Fatalf("Failed to read config file: %v", err)
 		}
 
-		if err := dbstrap.BootstrapDatabase(yamlFile); err != nil {
+		opts := dbstrap.Options{
+			Strict:         CLI.Run.Strict,
+			Prune:          CLI.Run.Prune,
+			PruneDatabases: CLI.Run.PruneDatabases,
+			ReassignTo:     CLI.Run.ReassignTo,
+		}
+		if err := dbstrap.BootstrapDatabaseWithOptions(yamlFile, opts); err != nil {
 			log.Fatalf("Failed to bootstrap database: %v", err)
 		}
+	case "validate":
+		yamlFile, err := os.ReadFile(CLI.Validate.Config)
+		if err != nil {
+			log.Fatalf("Failed to read config file: %v", err)
+		}
+
+		problems := dbstrap.Validate(yamlFile)
+		for _, problem := range problems {
+			if problem.Line > 0 {
+				fmt.Fprintf(os.Stderr, "%s:%d: %s\n", CLI.Validate.Config, problem.Line, problem.Message)
+			} else {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", CLI.Validate.Config, problem.Message)
+			}
+		}
+		if len(problems) > 0 {
+			os.Exit(1)
+		}
+		fmt.Printf("%s is valid\n", CLI.Validate.Config)
+	case "check":
+		yamlFile, err := os.ReadFile(CLI.Check.Config)
+		if err != nil {
+			log.Fatalf("Failed to read config file: %v", err)
+		}
+
+		drifted, err := dbstrap.Check(yamlFile, dbstrap.Options{Strict: CLI.Check.Strict}, os.Stdout)
+		if err != nil {
+			log.Fatalf("Failed to check database: %v", err)
+		}
+		if drifted {
+			os.Exit(2)
+		}
+	case "export":
+		dbURL := os.Getenv("DATABASE_URL")
+		if dbURL == "" {
+			log.Fatalf("DATABASE_URL must be set")
+		}
+
+		out := os.Stdout
+		if CLI.Export.Output != "" {
+			f, err := os.Create(CLI.Export.Output)
+			if err != nil {
+				log.Fatalf("Failed to create output file: %v", err)
+			}
+			defer f.Close()
+			out = f
+		}
+		if err := dbstrap.Export(context.Background(), dbURL, out); err != nil {
+			log.Fatalf("Failed to export cluster: %v", err)
+		}
 	default:
 		log.Fatalf("Unknown command: %s", kctx.Command())
 	}
@@ -0,0 +1,529 @@
+package dbstrap
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Export reads the roles, tablespaces, databases, schemas and settings of the
+// cluster in dbURL and writes them to w as a config that applies to the same
+// cluster without changes. Objects created by initdb are left out.
+func Export(ctx context.Context, dbURL string, w io.Writer) error {
+	conn, err := connect(ctx, dbURL, "", true)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
+
+	state, err := inspectCluster(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	catalogs := map[string]*databaseCatalog{}
+	for _, name := range sortedKeys(state.databases) {
+		db := state.databases[name]
+		if db.system || !db.allowConn {
+			continue
+		}
+		slog.Info("Inspecting database", "database", name)
+		catalog, err := inspectExportDatabase(ctx, dbURL, name)
+		if err != nil {
+			return err
+		}
+		catalogs[name] = catalog
+	}
+
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(exportConfig(state, catalogs)); err != nil {
+		return fmt.Errorf("failed to write config: %w", err)
+	}
+	return encoder.Close()
+}
+
+// inspectExportDatabase reads every user schema of a database
+func inspectExportDatabase(ctx context.Context, dbURL, dbName string) (*databaseCatalog, error) {
+	conn, err := connect(ctx, dbURL, dbName, true)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close(ctx)
+
+	rows, err := conn.Query(ctx, `SELECT nspname FROM pg_namespace
+		WHERE nspname !~ '^pg_' AND nspname NOT IN ('information_schema', 'dbstrap')`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schemas: %w", err)
+	}
+	var schemas []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to read schemas: %w", err)
+		}
+		schemas = append(schemas, name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read schemas: %w", err)
+	}
+
+	return inspectDatabase(ctx, conn, schemas)
+}
+
+// exportConfig builds a config from cluster and database snapshots. Roles that
+// are referenced but not exported are listed as external roles.
+func exportConfig(state *clusterState, catalogs map[string]*databaseCatalog) *Config {
+	config := &Config{}
+	exported := map[string]bool{}
+	for _, name := range sortedKeys(state.roles) {
+		role := state.roles[name]
+		if role.system || strings.HasPrefix(name, "pg_") {
+			continue
+		}
+		exported[name] = true
+		if role.canLogin {
+			config.Users = append(config.Users, User{
+				Name:           name,
+				CanLogin:       true,
+				Roles:          sortedKeys(role.memberOf),
+				RoleAttributes: role.exportAttributes(),
+				Settings:       state.settings[settingKey{role: name}],
+			})
+		} else {
+			config.Roles = append(config.Roles, Role{
+				Name:           name,
+				Roles:          sortedKeys(role.memberOf),
+				RoleAttributes: role.exportAttributes(),
+				Settings:       state.settings[settingKey{role: name}],
+			})
+		}
+	}
+
+	isUser := func(name string) bool {
+		role, ok := state.roles[name]
+		return ok && role.canLogin
+	}
+
+	for _, name := range sortedKeys(state.tablespaces) {
+		current := state.tablespaces[name]
+		if current.system {
+			continue
+		}
+		tablespace := Tablespace{Name: name, Location: current.location, Owner: current.owner}
+		if len(current.options) > 0 {
+			tablespace.Options = current.options
+		}
+		for _, grantee := range sortedKeys(current.acl) {
+			if grantee != current.owner {
+				tablespace.Grants = append(tablespace.Grants, TablespaceGrant{
+					User:       grantee,
+					Privileges: exportPrivileges(kindTablespace, current.acl[grantee]),
+				})
+			}
+		}
+		config.Tablespaces = append(config.Tablespaces, tablespace)
+	}
+
+	for _, name := range sortedKeys(state.databases) {
+		db := state.databases[name]
+		if db.system {
+			continue
+		}
+		// The template a database was copied from isn't recorded; template0
+		// accepts any encoding and locale
+		database := Database{
+			Name:      name,
+			Owner:     db.owner,
+			Encoding:  db.encoding,
+			LcCollate: db.collate,
+			LcCtype:   db.ctype,
+			Template:  "template0",
+			Settings:  state.settings[settingKey{database: name}],
+		}
+		if db.localeProvider != "libc" {
+			database.LocaleProvider = db.localeProvider
+			database.IcuLocale = db.icuLocale
+		}
+		if db.connLimit != -1 {
+			limit := db.connLimit
+			database.ConnectionLimit = &limit
+		}
+		if db.tablespace != "pg_default" {
+			database.Tablespace = db.tablespace
+		}
+		if !db.allowConn {
+			database.AllowConnections = &db.allowConn
+		}
+		if db.isTemplate {
+			database.IsTemplate = &db.isTemplate
+		}
+		for key, settings := range state.settings {
+			if key.database == name && key.role != "" {
+				if database.RoleSettings == nil {
+					database.RoleSettings = map[string]map[string]string{}
+				}
+				database.RoleSettings[key.role] = settings
+			}
+		}
+		for _, grantee := range sortedKeys(db.acl) {
+			if grantee == db.owner {
+				continue
+			}
+			database.Grants = append(database.Grants, DatabaseGrant{
+				User:       grantee,
+				Privileges: exportPrivileges(kindDatabase, db.acl[grantee]),
+			})
+		}
+		if catalog := catalogs[name]; catalog != nil {
+			// Versions aren't pinned, so the config keeps working after the
+			// server's extensions are upgraded
+			for _, name := range sortedKeys(catalog.extensions) {
+				if name == "plpgsql" {
+					continue
+				}
+				extension := Extension{Name: name}
+				if schema := catalog.extensions[name].schema; schema != "public" {
+					extension.Schema = schema
+				}
+				database.Extensions = append(database.Extensions, extension)
+			}
+			for _, schemaName := range sortedKeys(catalog.schemas) {
+				database.Schemas = append(database.Schemas, exportSchema(name, schemaName, catalog, isUser))
+			}
+		}
+		config.Databases = append(config.Databases, database)
+	}
+
+	config.ExternalRoles = externalRoles(config, exported)
+	return config
+}
+
+// exportAttributes returns the attributes that differ from CREATE ROLE's
+// defaults
+func (r *roleState) exportAttributes() RoleAttributes {
+	var attrs RoleAttributes
+	flag := func(v bool) *bool { return &v }
+	if r.superuser {
+		attrs.Superuser = flag(true)
+	}
+	if r.createDB {
+		attrs.CreateDB = flag(true)
+	}
+	if r.createRole {
+		attrs.CreateRole = flag(true)
+	}
+	if r.replication {
+		attrs.Replication = flag(true)
+	}
+	if r.bypassRLS {
+		attrs.BypassRLS = flag(true)
+	}
+	if !r.inherit {
+		attrs.Inherit = flag(false)
+	}
+	if r.connLimit != -1 {
+		limit := r.connLimit
+		attrs.ConnectionLimit = &limit
+	}
+	attrs.ValidUntil = r.validUntil
+	return attrs
+}
+
+// exportSchema turns a schema's ACL, the privileges every object of a kind
+// shares, privileges on individual objects and its default privileges into
+// schema grants, and adds the row-level security of its tables
+func exportSchema(dbName, name string, catalog *databaseCatalog, isUser func(string) bool) Schema {
+	state := catalog.schemas[name]
+	schema := Schema{Name: name, Owner: state.owner}
+
+	// Grants are keyed by grantee and the creator role of their default
+	// privileges; creators other than the owner get a grant of their own
+	grants := map[string]*SchemaGrant{}
+	grantFor := func(grantee, creator string) *SchemaGrant {
+		key := grantee + "\x00" + creator
+		if grants[key] == nil {
+			grants[key] = &SchemaGrant{}
+			if isUser(grantee) || grantee == "PUBLIC" {
+				grants[key].User = grantee
+			} else {
+				grants[key].Role = grantee
+			}
+			if creator != "" {
+				grants[key].ForRoles = []string{creator}
+			}
+		}
+		return grants[key]
+	}
+	grant := func(grantee string) *SchemaGrant {
+		return grantFor(grantee, "")
+	}
+
+	for _, grantee := range sortedKeys(state.acl) {
+		if grantee != state.owner {
+			grant(grantee).Privileges = exportPrivileges(kindSchema, state.acl[grantee])
+		}
+	}
+
+	for _, kind := range []objectKind{kindTable, kindSequence, kindFunction} {
+		objects := state.objects[kind]
+		if len(objects) == 0 {
+			continue
+		}
+		shared := sharedPrivileges(kind, objects)
+		for _, grantee := range sortedKeys(shared) {
+			privileges := shared[grantee]
+			g := grant(grantee)
+			switch kind {
+			case kindTable:
+				g.TablePrivileges = privileges
+			case kindSequence:
+				g.SequencePrivileges = privileges
+			case kindFunction:
+				g.FunctionPrivileges = privileges
+			}
+		}
+
+		// Whatever an object grants beyond the shared privileges becomes a
+		// grant on that object
+		for _, key := range sortedKeys(objects) {
+			object := objects[key]
+			for _, grantee := range sortedKeys(object.acl) {
+				if grantee == object.owner {
+					continue
+				}
+				extra := map[string]bool{}
+				for privilege := range object.acl[grantee] {
+					extra[privilege] = true
+				}
+				for _, privilege := range shared[grantee] {
+					delete(extra, privilege)
+				}
+				if privileges := exportPrivileges(kind, extra); len(privileges) > 0 {
+					g := grant(grantee)
+					g.Objects = append(g.Objects, ObjectGrant{
+						Type:       string(kind),
+						Name:       strings.TrimSuffix(key, "("+object.args+")"),
+						Args:       object.args,
+						Privileges: privileges,
+					})
+				}
+			}
+		}
+	}
+
+	for key, acl := range catalog.defaultACLs {
+		if key.schema != name {
+			continue
+		}
+		creator := ""
+		if key.forRole != state.owner {
+			creator = key.forRole
+		}
+		for _, grantee := range sortedKeys(acl) {
+			if grantee == key.forRole {
+				continue
+			}
+			g := grantFor(grantee, creator)
+			privileges := exportPrivileges(key.kind, acl[grantee])
+			switch key.kind {
+			case kindTable:
+				g.DefaultPrivileges = privileges
+			case kindSequence:
+				g.DefaultSequencePrivileges = privileges
+			case kindFunction:
+				g.DefaultFunctionPrivileges = privileges
+			case kindType:
+				g.DefaultTypePrivileges = privileges
+			}
+		}
+	}
+
+	for _, key := range sortedKeys(grants) {
+		schema.Grants = append(schema.Grants, *grants[key])
+	}
+
+	// Column grants are grouped into one entry per table, grantee and set of
+	// privileges
+	tables := state.objects[kindTable]
+	for _, table := range sortedKeys(tables) {
+		columns := map[string]map[string][]string{}
+		for _, column := range sortedKeys(tables[table].columns) {
+			acl := tables[table].columns[column]
+			for _, grantee := range sortedKeys(acl) {
+				privileges := strings.Join(exportPrivileges(kindColumn, acl[grantee]), ",")
+				if columns[grantee] == nil {
+					columns[grantee] = map[string][]string{}
+				}
+				columns[grantee][privileges] = append(columns[grantee][privileges], column)
+			}
+		}
+		for _, grantee := range sortedKeys(columns) {
+			for _, privileges := range sortedKeys(columns[grantee]) {
+				grant := ColumnGrant{
+					Table:      table,
+					Columns:    columns[grantee][privileges],
+					Privileges: strings.Split(privileges, ","),
+				}
+				if isUser(grantee) || grantee == "PUBLIC" {
+					grant.User = grantee
+				} else {
+					grant.Role = grantee
+				}
+				schema.ColumnGrants = append(schema.ColumnGrants, grant)
+			}
+		}
+	}
+
+	for _, table := range sortedKeys(tables) {
+		if rls := exportRowSecurity(table, tables[table]); rls != nil {
+			schema.RowSecurity = append(schema.RowSecurity, *rls)
+		}
+	}
+	return schema
+}
+
+// exportRowSecurity returns the row-level security of a table, or nil when it
+// is off and the table has no policies
+func exportRowSecurity(table string, state *objectState) *TableRowSecurity {
+	if !state.rowSecurity && !state.forceRowSecurity && len(state.policies) == 0 {
+		return nil
+	}
+	rls := &TableRowSecurity{Table: table}
+	flag := func(v bool) *bool { return &v }
+	if state.rowSecurity {
+		rls.Enable = flag(true)
+	}
+	if state.forceRowSecurity {
+		rls.Force = flag(true)
+	}
+	for _, name := range sortedKeys(state.policies) {
+		policy := state.policies[name]
+		exported := Policy{
+			Name:        name,
+			Restrictive: policy.restrictive,
+			Using:       policy.using,
+			WithCheck:   policy.withCheck,
+		}
+		if policy.command != "ALL" {
+			exported.Command = policy.command
+		}
+		if len(policy.roles) != 1 || policy.roles[0] != "PUBLIC" {
+			exported.Roles = policy.roles
+		}
+		rls.Policies = append(rls.Policies, exported)
+	}
+	return rls
+}
+
+// sharedPrivileges returns, for each grantee, the privileges it holds on every
+// object of kind; grantees owning every object are skipped
+func sharedPrivileges(kind objectKind, objects map[string]*objectState) map[string][]string {
+	counts := map[string]map[string]int{}
+	owned := map[string]int{}
+	for _, object := range objects {
+		owned[object.owner]++
+		for grantee, privileges := range object.acl {
+			if counts[grantee] == nil {
+				counts[grantee] = map[string]int{}
+			}
+			for privilege := range privileges {
+				counts[grantee][privilege]++
+			}
+		}
+	}
+
+	shared := map[string][]string{}
+	for grantee, privileges := range counts {
+		if owned[grantee] == len(objects) {
+			continue
+		}
+		all := map[string]bool{}
+		for privilege, n := range privileges {
+			if n == len(objects) {
+				all[privilege] = true
+			}
+		}
+		if len(all) > 0 {
+			shared[grantee] = exportPrivileges(kind, all)
+		}
+	}
+	return shared
+}
+
+// exportPrivileges lists privileges in the order ALL expands to
+func exportPrivileges(kind objectKind, privileges map[string]bool) []string {
+	var list []string
+	for _, privilege := range objectPrivileges[kind] {
+		if privileges[privilege] {
+			list = append(list, privilege)
+		}
+	}
+	return list
+}
+
+// externalRoles returns the roles config refers to that it doesn't declare,
+// other than PUBLIC and predefined roles
+func externalRoles(config *Config, declared map[string]bool) []string {
+	external := map[string]bool{}
+	add := func(name string) {
+		if name != "" && !declared[name] && canonicalGrantee(name) != "PUBLIC" && !strings.HasPrefix(name, "pg_") {
+			external[name] = true
+		}
+	}
+	for _, role := range config.Roles {
+		for _, granted := range role.Roles {
+			add(granted)
+		}
+	}
+	for _, user := range config.Users {
+		for _, granted := range user.Roles {
+			add(granted)
+		}
+	}
+	for _, tablespace := range config.Tablespaces {
+		add(tablespace.Owner)
+		for _, grant := range tablespace.Grants {
+			add(grant.User)
+		}
+	}
+	for _, db := range config.Databases {
+		add(db.Owner)
+		for role := range db.RoleSettings {
+			add(role)
+		}
+		for _, grant := range db.Grants {
+			add(grant.User)
+		}
+		for _, schema := range db.Schemas {
+			add(schema.Owner)
+			for _, creator := range schema.ForRoles {
+				add(creator)
+			}
+			for _, grant := range schema.Grants {
+				add(grant.User)
+				add(grant.Role)
+				for _, creator := range grant.ForRoles {
+					add(creator)
+				}
+			}
+			for _, grant := range schema.ColumnGrants {
+				add(grant.User)
+				add(grant.Role)
+			}
+			for _, rls := range schema.RowSecurity {
+				for _, policy := range rls.Policies {
+					for _, name := range policy.Roles {
+						add(name)
+					}
+				}
+			}
+		}
+	}
+	return sortedKeys(external)
+}
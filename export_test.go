@@ -0,0 +1,197 @@
+package dbstrap
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+// exportFixture returns a cluster and database snapshot set up by hand
+func exportFixture() (*clusterState, map[string]*databaseCatalog) {
+	state := newClusterState()
+	state.roles["postgres"] = &roleState{canLogin: true, superuser: true, inherit: true, connLimit: -1, memberOf: map[string]bool{}, system: true}
+	state.roles["pg_read_all_data"] = &roleState{inherit: true, connLimit: -1, memberOf: map[string]bool{}, system: true}
+	state.roles["app_readonly"] = &roleState{inherit: true, connLimit: -1, memberOf: map[string]bool{"pg_read_all_data": true}}
+	state.roles["app_user"] = &roleState{canLogin: true, createDB: true, inherit: true, connLimit: 10, memberOf: map[string]bool{"app_readonly": true}}
+
+	state.tablespaces["pg_default"] = &tablespaceState{owner: "postgres", acl: aclSet{}, system: true}
+	state.tablespaces["fast_ssd"] = &tablespaceState{owner: "app_user", location: "/mnt/ssd", acl: aclSet{},
+		options: map[string]string{"random_page_cost": "1.1"}}
+	state.tablespaces["fast_ssd"].acl.declare("app_user", []string{"CREATE"})
+	state.tablespaces["fast_ssd"].acl.declare("app_readonly", []string{"CREATE"})
+
+	state.databases["postgres"] = &databaseState{owner: "postgres", allowConn: true, acl: aclSet{}, system: true}
+	state.databases["app"] = &databaseState{owner: "app_user", encoding: "UTF8", collate: "C", ctype: "C", allowConn: true, acl: aclSet{},
+		connLimit: -1, tablespace: "pg_default", localeProvider: "icu", icuLocale: "en-US"}
+	state.databases["app"].acl.declare("app_user", []string{"CREATE", "CONNECT", "TEMPORARY"})
+	state.databases["app"].acl.declare("PUBLIC", []string{"CONNECT", "TEMPORARY"})
+	state.databases["app"].acl.declare("app_readonly", []string{"CONNECT"})
+
+	state.settings[settingKey{role: "app_user"}] = map[string]string{"statement_timeout": "30s"}
+	state.settings[settingKey{role: "app_readonly"}] = map[string]string{"default_transaction_read_only": "on"}
+	state.settings[settingKey{role: "app_user", database: "app"}] = map[string]string{"search_path": `"$user", app`}
+
+	catalog := newDatabaseCatalog()
+	catalog.extensions["plpgsql"] = &extensionState{version: "1.0", schema: "pg_catalog"}
+	catalog.extensions["pgcrypto"] = &extensionState{version: "1.3", schema: "extensions"}
+	schema := &schemaState{owner: "app_user", acl: aclSet{}, objects: map[objectKind]map[string]*objectState{}}
+	schema.acl.declare("app_user", []string{"USAGE", "CREATE"})
+	schema.acl.declare("app_readonly", []string{"USAGE"})
+	schema.objects[kindTable] = map[string]*objectState{
+		"orders": {owner: "app_user", acl: aclSet{}},
+		"items":  {owner: "app_user", acl: aclSet{}},
+	}
+	for _, table := range schema.objects[kindTable] {
+		table.acl.declare("app_user", []string{"SELECT", "INSERT", "UPDATE", "DELETE", "TRUNCATE", "REFERENCES", "TRIGGER"})
+		table.acl.declare("app_readonly", []string{"SELECT"})
+	}
+	schema.objects[kindTable]["orders"].acl.declare("app_readonly", []string{"UPDATE"})
+	schema.objects[kindTable]["orders"].rowSecurity = true
+	schema.objects[kindTable]["orders"].policies = map[string]*policyState{
+		"own_orders": {command: "SELECT", roles: []string{"app_readonly"}, using: "(owner = CURRENT_USER)"},
+	}
+	schema.objects[kindTable]["items"].columns = map[string]aclSet{
+		"price": {"app_readonly": {"UPDATE": true}},
+		"sku":   {"app_readonly": {"UPDATE": true}},
+	}
+	catalog.schemas["app"] = schema
+	catalog.defaultACLs[defaultACLKey{forRole: "app_user", schema: "app", kind: kindTable}] = aclSet{}
+	catalog.defaultACLs[defaultACLKey{forRole: "app_user", schema: "app", kind: kindTable}].declare("app_readonly", []string{"SELECT"})
+	catalog.defaultACLs[defaultACLKey{forRole: "migrator", schema: "app", kind: kindSequence}] = aclSet{}
+	catalog.defaultACLs[defaultACLKey{forRole: "migrator", schema: "app", kind: kindSequence}].declare("app_readonly", []string{"USAGE"})
+
+	return state, map[string]*databaseCatalog{"app": catalog}
+}
+
+// TestExportConfig tests that export leaves out system objects and turns
+// catalogs into grants
+func TestExportConfig(t *testing.T) {
+	state, catalogs := exportFixture()
+	config := exportConfig(state, catalogs)
+
+	var out bytes.Buffer
+	encoder := yaml.NewEncoder(&out)
+	encoder.SetIndent(2)
+	require.NoError(t, encoder.Encode(config))
+
+	assert.Equal(t, `roles:
+  - name: app_readonly
+    roles:
+      - pg_read_all_data
+    settings:
+      default_transaction_read_only: "on"
+users:
+  - name: app_user
+    can_login: true
+    roles:
+      - app_readonly
+    createdb: true
+    connection_limit: 10
+    settings:
+      statement_timeout: 30s
+tablespaces:
+  - name: fast_ssd
+    location: /mnt/ssd
+    owner: app_user
+    options:
+      random_page_cost: "1.1"
+    grants:
+      - user: app_readonly
+        privileges:
+          - CREATE
+databases:
+  - name: app
+    owner: app_user
+    encoding: UTF8
+    lc_collate: C
+    lc_ctype: C
+    template: template0
+    locale_provider: icu
+    icu_locale: en-US
+    extensions:
+      - name: pgcrypto
+        schema: extensions
+    grants:
+      - user: PUBLIC
+        privileges:
+          - CONNECT
+          - TEMPORARY
+      - user: app_readonly
+        privileges:
+          - CONNECT
+    schemas:
+      - name: app
+        owner: app_user
+        grants:
+          - role: app_readonly
+            privileges:
+              - USAGE
+            table_privileges:
+              - SELECT
+            default_privileges:
+              - SELECT
+            objects:
+              - type: table
+                name: orders
+                privileges:
+                  - UPDATE
+          - role: app_readonly
+            default_sequence_privileges:
+              - USAGE
+            for_roles:
+              - migrator
+        column_grants:
+          - table: items
+            columns:
+              - price
+              - sku
+            role: app_readonly
+            privileges:
+              - UPDATE
+        row_security:
+          - table: orders
+            enable: true
+            policies:
+              - name: own_orders
+                command: SELECT
+                roles:
+                  - app_readonly
+                using: (owner = CURRENT_USER)
+    role_settings:
+      app_user:
+        search_path: '"$user", app'
+external_roles:
+  - migrator
+`, out.String())
+	assert.Empty(t, Validate(out.Bytes()))
+}
+
+// TestExportRoundTrip tests that an exported config plans no changes against
+// the cluster it was exported from
+func TestExportRoundTrip(t *testing.T) {
+	state, catalogs := exportFixture()
+	config := exportConfig(state, catalogs)
+
+	steps, err := planRoles(config.Roles, state)
+	require.NoError(t, err)
+	userSteps, err := planUsers(config.Users, state)
+	require.NoError(t, err)
+	steps = append(steps, userSteps...)
+	dbSteps, err := planDatabases(config.Databases, state, Options{Strict: true})
+	require.NoError(t, err)
+	steps = append(steps, dbSteps...)
+	steps = append(steps, planSettings(config, state, Options{Strict: true})...)
+	for _, db := range config.Databases {
+		steps = append(steps, planExtensions(db.Name, db.Extensions, catalogs[db.Name])...)
+		schemaSteps, err := planSchemas(db.Name, db.Schemas, catalogs[db.Name], Options{Strict: true})
+		require.NoError(t, err)
+		steps = append(steps, schemaSteps...)
+	}
+
+	for _, step := range steps {
+		assert.Equal(t, ActionNoop, step.Action, step.SQL)
+	}
+}
@@ -29,22 +29,17 @@ func TestIntegration(t *testing.T) {
 	os.Setenv("TEST_USER_PASSWORD", "testpass123")
 	defer os.Unsetenv("TEST_USER_PASSWORD")
 
-	// Connect to create the role first
 	ctx := context.Background()
-	setupConn, err := pgx.Connect(ctx, dbURL)
-	require.NoError(t, err)
-	
+
 	// Use a timestamp suffix to create unique role names for this test run
 	timeStamp := time.Now().UnixNano()
 	roleName := fmt.Sprintf("dbstrap_readonly_role_%d", timeStamp)
-	
-	// Create the readonly role (since bootstrap doesn't handle roles yet)
-	_, err = setupConn.Exec(ctx, fmt.Sprintf("CREATE ROLE %s", roleName))
-	require.NoError(t, err)
-	setupConn.Close(ctx)
-	
+
 	// Format the YAML with the role name
 	yamlStr := fmt.Sprintf(`
+roles:
+  - name: %s
+
 users:
   - name: dbstrap_test_user
     password_env: TEST_USER_PASSWORD
@@ -104,10 +99,10 @@ databases:
             sequence_privileges: [USAGE, SELECT]
             function_privileges: [EXECUTE]
             default_privileges: [SELECT]
-`, roleName, roleName, roleName)
-	
+`, roleName, roleName, roleName, roleName)
+
 	// Now run bootstrap
-	err = BootstrapDatabase([]byte(yamlStr))
+	err := BootstrapDatabase([]byte(yamlStr))
 	require.NoError(t, err)
 
 	// Connect to the test database
@@ -0,0 +1,170 @@
+package dbstrap
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// loadPasswords sets user passwords from their password_env, password_file,
+// password_command or password_vault. A source that is missing or empty is an error when
+// required is true and leaves the password unset otherwise. With skipEnv,
+// users whose password comes from an environment variable are left alone.
+func loadPasswords(config *Config, required, skipEnv bool) error {
+	slog.Info("Reading user passwords")
+	reader := &passwordReader{}
+	for i := range config.Users {
+		user := &config.Users[i]
+		if skipEnv && user.PasswordEnv != "" {
+			continue
+		}
+		pw, err := reader.read(context.Background(), *user)
+		if err != nil {
+			if required {
+				return err
+			}
+			slog.Warn("Password not available", "user", user.Name, "error", err)
+			continue
+		}
+		user.Password = pw
+	}
+	return nil
+}
+
+// passwordCommandTimeout bounds how long a password_command may run, so a
+// hung helper can't block a run or a scheduled check
+var passwordCommandTimeout = 30 * time.Second
+
+// passwordReader reads user passwords from their sources. The Vault client is
+// set up on first use, so users that share it log in only once.
+type passwordReader struct {
+	vault *vaultClient
+}
+
+// read reads the password of user from its source. Users without a source
+// have no password.
+func (r *passwordReader) read(ctx context.Context, user User) (string, error) {
+	switch {
+	case user.PasswordEnv != "":
+		pw := os.Getenv(user.PasswordEnv)
+		if pw == "" {
+			return "", fmt.Errorf("missing env var: %s for user %s", user.PasswordEnv, user.Name)
+		}
+		return pw, nil
+	case user.PasswordFile != "":
+		data, err := os.ReadFile(user.PasswordFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read password_file for user %s: %w", user.Name, err)
+		}
+		pw := strings.TrimRight(string(data), "\r\n")
+		if pw == "" {
+			return "", fmt.Errorf("password_file %s for user %s is empty", user.PasswordFile, user.Name)
+		}
+		return pw, nil
+	case len(user.PasswordCommand) > 0:
+		ctx, cancel := context.WithTimeout(ctx, passwordCommandTimeout)
+		defer cancel()
+		var stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, user.PasswordCommand[0], user.PasswordCommand[1:]...)
+		cmd.Stderr = &stderr
+		// Children that inherited the output pipes can't hold it open
+		cmd.WaitDelay = time.Second
+		out, err := cmd.Output()
+		if err != nil {
+			if ctx.Err() != nil {
+				err = fmt.Errorf("timed out after %s", passwordCommandTimeout)
+			} else if stderr.Len() > 0 {
+				err = fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+			}
+			return "", fmt.Errorf("password_command %s for user %s failed: %w", user.PasswordCommand[0], user.Name, err)
+		}
+		pw := strings.TrimRight(string(out), "\r\n")
+		if pw == "" {
+			return "", fmt.Errorf("password_command %s for user %s printed no password", user.PasswordCommand[0], user.Name)
+		}
+		return pw, nil
+	case user.PasswordVault != "":
+		path, key, err := splitVaultRef(user.PasswordVault)
+		if err != nil {
+			return "", err
+		}
+		if r.vault == nil {
+			if r.vault, err = newVaultClient(); err != nil {
+				return "", err
+			}
+		}
+		pw, err := r.vault.readKV(ctx, path, key)
+		if err != nil {
+			return "", fmt.Errorf("password_vault for user %s: %w", user.Name, err)
+		}
+		if pw == "" {
+			return "", fmt.Errorf("password_vault %s for user %s is empty", user.PasswordVault, user.Name)
+		}
+		return pw, nil
+	}
+	return "", nil
+}
+
+// passwordMatches reports whether verifier, as stored in pg_authid.rolpassword,
+// was derived from password. Both SCRAM-SHA-256 and legacy MD5 verifiers are
+// understood; anything else never matches.
+func passwordMatches(verifier, roleName, password string) bool {
+	switch {
+	case strings.HasPrefix(verifier, "SCRAM-SHA-256$"):
+		return scramMatches(verifier, password)
+	case strings.HasPrefix(verifier, "md5") && len(verifier) == 35:
+		sum := md5.Sum([]byte(password + roleName))
+		return subtle.ConstantTimeCompare([]byte(verifier[3:]), []byte(hex.EncodeToString(sum[:]))) == 1
+	}
+	return false
+}
+
+// scramMatches checks a verifier of the form
+// SCRAM-SHA-256$<iterations>:<salt>$<StoredKey>:<ServerKey>
+func scramMatches(verifier, password string) bool {
+	parts := strings.Split(strings.TrimPrefix(verifier, "SCRAM-SHA-256$"), "$")
+	if len(parts) != 2 {
+		return false
+	}
+	iterSalt := strings.SplitN(parts[0], ":", 2)
+	keys := strings.SplitN(parts[1], ":", 2)
+	if len(iterSalt) != 2 || len(keys) != 2 {
+		return false
+	}
+	iterations, err := strconv.Atoi(iterSalt[0])
+	if err != nil || iterations <= 0 {
+		return false
+	}
+	salt, err := base64.StdEncoding.DecodeString(iterSalt[1])
+	if err != nil {
+		return false
+	}
+	storedKey, err := base64.StdEncoding.DecodeString(keys[0])
+	if err != nil {
+		return false
+	}
+
+	// PostgreSQL normalizes passwords with SASLprep, which leaves ASCII
+	// passwords unchanged; non-ASCII passwords may fail to match and are then
+	// simply set again
+	salted := pbkdf2.Key([]byte(password), salt, iterations, sha256.Size, sha256.New)
+	mac := hmac.New(sha256.New, salted)
+	mac.Write([]byte("Client Key"))
+	clientKey := mac.Sum(nil)
+	computed := sha256.Sum256(clientKey)
+	return subtle.ConstantTimeCompare(storedKey, computed[:]) == 1
+}
@@ -0,0 +1,116 @@
+package dbstrap
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testSCRAMVerifier = "SCRAM-SHA-256$4096:MDEyMzQ1Njc4OWFiY2RlZg==$SRTUZCoJ9pyw8BW6rNia3SiZgch+6hFQOA7mo/mlSd0=:+/FTmLakv3tFm8KF2Zqii1ci2pM5xyUoWvq5jBgcySg="
+	testMD5Verifier   = "md5b8c3bb082c12578bb2271c61327f2777"
+)
+
+// TestPasswordMatches tests comparing passwords with stored verifiers
+func TestPasswordMatches(t *testing.T) {
+	assert.True(t, passwordMatches(testSCRAMVerifier, "app_user", "testpass123"))
+	assert.False(t, passwordMatches(testSCRAMVerifier, "app_user", "testpass124"))
+	assert.True(t, passwordMatches(testMD5Verifier, "app_user", "testpass123"))
+	assert.False(t, passwordMatches(testMD5Verifier, "other_user", "testpass123"))
+	assert.False(t, passwordMatches("", "app_user", "testpass123"))
+	assert.False(t, passwordMatches("SCRAM-SHA-256$bogus", "app_user", "testpass123"))
+}
+
+// TestPlanUsersSyncPassword tests that passwords of existing roles are only
+// changed when syncing is enabled and the verifier differs
+func TestPlanUsersSyncPassword(t *testing.T) {
+	sync := true
+	state := newClusterState()
+	state.roles["app_user"] = &roleState{canLogin: true, memberOf: map[string]bool{}, password: testSCRAMVerifier, passwordKnown: true}
+	state.roles["unknown_user"] = &roleState{canLogin: true, memberOf: map[string]bool{}}
+
+	users := []User{
+		{Name: "app_user", CanLogin: true, Password: "testpass123", SyncPassword: &sync},
+		{Name: "app_user", CanLogin: true, Password: "rotated", SyncPassword: &sync},
+		{Name: "app_user", CanLogin: true, Password: "rotated"},
+		{Name: "unknown_user", CanLogin: true, Password: "testpass123", SyncPassword: &sync},
+	}
+
+	steps, err := planUsers(users, state)
+	require.NoError(t, err)
+	require.Len(t, steps, 7)
+	assert.Equal(t, ActionNoop, steps[1].Action, "matching password is left alone")
+	assert.Equal(t, ActionUpdate, steps[3].Action, "rotated password is set")
+	assert.Equal(t, "ALTER ROLE app_user WITH PASSWORD 'rotated'", steps[3].SQL)
+	assert.Equal(t, "ALTER ROLE app_user WITH PASSWORD '********'", steps[3].String())
+	assert.Equal(t, ActionNoop, steps[4].Action, "without sync only CREATE ROLE is planned")
+	assert.Equal(t, ActionUpdate, steps[6].Action, "unreadable verifiers are always reset")
+}
+
+// TestReadPassword tests reading passwords from files and commands
+func TestReadPassword(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	secret := filepath.Join(dir, "secret")
+	require.NoError(t, os.WriteFile(secret, []byte("s3cret\n"), 0o600))
+	empty := filepath.Join(dir, "empty")
+	require.NoError(t, os.WriteFile(empty, []byte("\n"), 0o600))
+	t.Setenv("APP_PASSWORD", "from-env")
+
+	reader := &passwordReader{}
+	pw, err := reader.read(ctx, User{Name: "app_user", PasswordEnv: "APP_PASSWORD"})
+	require.NoError(t, err)
+	assert.Equal(t, "from-env", pw)
+
+	pw, err = reader.read(ctx, User{Name: "app_user", PasswordFile: secret})
+	require.NoError(t, err)
+	assert.Equal(t, "s3cret", pw, "the trailing newline is trimmed")
+
+	pw, err = reader.read(ctx, User{Name: "app_user", PasswordCommand: []string{"sh", "-c", "printf 'from command\\n'"}})
+	require.NoError(t, err)
+	assert.Equal(t, "from command", pw)
+
+	pw, err = reader.read(ctx, User{Name: "app_user"})
+	require.NoError(t, err)
+	assert.Empty(t, pw, "users without a source have no password")
+
+	_, err = reader.read(ctx, User{Name: "app_user", PasswordEnv: "MISSING_PASSWORD"})
+	assert.EqualError(t, err, "missing env var: MISSING_PASSWORD for user app_user")
+	_, err = reader.read(ctx, User{Name: "app_user", PasswordFile: filepath.Join(dir, "missing")})
+	assert.ErrorContains(t, err, "failed to read password_file for user app_user")
+	_, err = reader.read(ctx, User{Name: "app_user", PasswordFile: empty})
+	assert.EqualError(t, err, "password_file "+empty+" for user app_user is empty")
+	_, err = reader.read(ctx, User{Name: "app_user", PasswordCommand: []string{"sh", "-c", "echo denied >&2; exit 3"}})
+	assert.EqualError(t, err, "password_command sh for user app_user failed: exit status 3: denied")
+	_, err = reader.read(ctx, User{Name: "app_user", PasswordCommand: []string{"true"}})
+	assert.EqualError(t, err, "password_command true for user app_user printed no password")
+
+	timeout := passwordCommandTimeout
+	passwordCommandTimeout = 100 * time.Millisecond
+	t.Cleanup(func() { passwordCommandTimeout = timeout })
+	_, err = reader.read(ctx, User{Name: "app_user", PasswordCommand: []string{"sleep", "10"}})
+	assert.EqualError(t, err, "password_command sleep for user app_user failed: timed out after 100ms")
+}
+
+// TestLoadPasswords tests that unreadable passwords only fail when required
+// and that environment variables can be left to psql
+func TestLoadPasswords(t *testing.T) {
+	config := &Config{Users: []User{
+		{Name: "app_user", PasswordEnv: "MISSING_PASSWORD"},
+		{Name: "migrator", PasswordCommand: []string{"echo", "m1gr4tor"}},
+	}}
+
+	assert.Error(t, loadPasswords(config, true, false))
+	require.NoError(t, loadPasswords(config, true, true))
+	assert.Equal(t, "m1gr4tor", config.Users[1].Password)
+
+	config.Users[1].Password = ""
+	require.NoError(t, loadPasswords(config, false, false))
+	assert.Empty(t, config.Users[0].Password)
+	assert.Equal(t, "m1gr4tor", config.Users[1].Password)
+}
@@ -0,0 +1,1065 @@
+package dbstrap
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Action describes the effect a planned statement has on the cluster
+type Action string
+
+const (
+	ActionCreate Action = "create"
+	ActionUpdate Action = "update"
+	ActionDrop   Action = "drop"
+	ActionNoop   Action = "no-op"
+)
+
+// Step is a single statement in a bootstrap plan
+type Step struct {
+	Action Action
+	// Database is the database the statement runs in; empty for cluster-wide
+	// statements that run on the DATABASE_URL connection
+	Database string
+	SQL      string
+	// Redacted is SQL with secrets masked, used for logging and plan output
+	Redacted string
+	// Unverified marks an update planned because the current state can't be
+	// read, such as a password verifier hidden from the connecting role;
+	// check lists it without counting it as drift
+	Unverified bool
+}
+
+// String returns the statement with any secrets masked
+func (s Step) String() string {
+	if s.Redacted != "" {
+		return s.Redacted
+	}
+	return s.SQL
+}
+
+// Plan is the ordered list of statements a bootstrap run would execute
+type Plan struct {
+	Steps []Step
+	// Drift lists differences from the configuration that no statement
+	// corrects, such as the encoding of an existing database
+	Drift []string
+}
+
+// Changes returns the steps that change something
+func (p *Plan) Changes() []Step {
+	var changes []Step
+	for _, step := range p.Steps {
+		if step.Action != ActionNoop {
+			changes = append(changes, step)
+		}
+	}
+	return changes
+}
+
+// Count returns the number of steps with the given action
+func (p *Plan) Count(action Action) int {
+	n := 0
+	for _, step := range p.Steps {
+		if step.Action == action {
+			n++
+		}
+	}
+	return n
+}
+
+// Write prints the plan in execution order, grouped by database
+func (p *Plan) Write(w io.Writer) error {
+	if err := writeSteps(w, p.Steps, p.Drift); err != nil {
+		return err
+	}
+	summary := fmt.Sprintf("Plan: %d to create, %d to update", p.Count(ActionCreate), p.Count(ActionUpdate))
+	if drops := p.Count(ActionDrop); drops > 0 {
+		summary += fmt.Sprintf(", %d to drop", drops)
+	}
+	_, err := fmt.Fprintf(w, "%s, %d unchanged.\n", summary, p.Count(ActionNoop))
+	return err
+}
+
+// writeSteps prints steps grouped by database, followed by drift
+func writeSteps(w io.Writer, steps []Step, drift []string) error {
+	current := "\x00"
+	for _, step := range steps {
+		if step.Database != current {
+			current = step.Database
+			header := "-- cluster"
+			if current != "" {
+				header = "-- database " + current
+			}
+			if _, err := fmt.Fprintln(w, header); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%-7s %s;\n", step.Action, step); err != nil {
+			return err
+		}
+	}
+	for _, d := range drift {
+		if _, err := fmt.Fprintf(w, "%-7s %s\n", "drift", d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// objectPrivileges lists the privileges ALL expands to for each object kind
+var objectPrivileges = map[objectKind][]string{
+	kindDatabase: {"CREATE", "CONNECT", "TEMPORARY"},
+	kindSchema:   {"USAGE", "CREATE"},
+	kindTable:    {"SELECT", "INSERT", "UPDATE", "DELETE", "TRUNCATE", "REFERENCES", "TRIGGER"},
+	kindSequence: {"USAGE", "SELECT", "UPDATE"},
+	kindFunction: {"EXECUTE"},
+	kindType:     {"USAGE"},
+	kindColumn:   {"SELECT", "INSERT", "UPDATE", "REFERENCES"},
+
+	kindTablespace: {"CREATE"},
+}
+
+// normalizePrivileges upper-cases privilege names and expands ALL and TEMP to
+// the names reported by aclexplode
+func normalizePrivileges(kind objectKind, privileges []string) []string {
+	var result []string
+	for _, p := range privileges {
+		p = strings.ToUpper(strings.Join(strings.Fields(p), " "))
+		switch p {
+		case "ALL", "ALL PRIVILEGES":
+			result = append(result, objectPrivileges[kind]...)
+		case "TEMP":
+			result = append(result, "TEMPORARY")
+		default:
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// actionFor returns ActionNoop when done is true and fallback otherwise
+func actionFor(done bool, fallback Action) Action {
+	if done {
+		return ActionNoop
+	}
+	return fallback
+}
+
+// planRoles plans the statements that create group roles and grant their
+// memberships. Every role is created before any membership is granted, so
+// roles may be members of roles listed after them.
+func planRoles(roles []Role, state *clusterState) ([]Step, error) {
+	var steps, memberships []Step
+	for _, r := range roles {
+		current, exists := state.roles[r.Name]
+		steps = append(steps, Step{
+			Action: actionFor(exists, ActionCreate),
+			SQL:    createRoleSQL(r.Name, false, r.RoleAttributes, ""),
+		})
+
+		// Existing roles are moved to the declared attributes
+		if exists {
+			var opts []string
+			if current.canLogin {
+				opts = append(opts, "NOLOGIN")
+			}
+			opts = append(opts, r.options(current)...)
+			if len(opts) > 0 {
+				steps = append(steps, Step{Action: ActionUpdate, SQL: alterRoleSQL(r.Name, opts)})
+			}
+		}
+
+		for _, m := range r.Roles {
+			memberships = append(memberships, Step{
+				Action: actionFor(exists && current.memberOf[m], ActionUpdate),
+				SQL:    grantRoleSQL(m, r.Name),
+			})
+		}
+	}
+	return append(steps, memberships...), nil
+}
+
+// planUsers plans the statements that create users and grant them roles
+func planUsers(users []User, state *clusterState) ([]Step, error) {
+	var steps []Step
+	for _, user := range users {
+		role, exists := state.roles[user.Name]
+
+		step := Step{
+			Action: actionFor(exists, ActionCreate),
+			SQL:    createRoleSQL(user.Name, user.CanLogin, user.RoleAttributes, user.Password),
+		}
+		if user.Password != "" {
+			step.Redacted = createRoleSQL(user.Name, user.CanLogin, user.RoleAttributes, "********")
+		}
+		steps = append(steps, step)
+
+		// Existing roles are moved to the declared attributes
+		if exists {
+			var opts []string
+			if user.CanLogin && !role.canLogin {
+				opts = append(opts, "LOGIN")
+			}
+			opts = append(opts, user.options(role)...)
+			if len(opts) > 0 {
+				steps = append(steps, Step{Action: ActionUpdate, SQL: alterRoleSQL(user.Name, opts)})
+			}
+		}
+
+		// Existing roles only get a new password when syncing is enabled and
+		// the stored verifier doesn't already match
+		if exists && user.syncPassword() && user.CanLogin && user.Password != "" {
+			matches := role.passwordKnown && passwordMatches(role.password, user.Name, user.Password)
+			steps = append(steps, Step{
+				Action:     actionFor(matches, ActionUpdate),
+				SQL:        alterRolePasswordSQL(user.Name, user.Password),
+				Redacted:   alterRolePasswordSQL(user.Name, "********"),
+				Unverified: !role.passwordKnown,
+			})
+		}
+
+		for _, r := range user.Roles {
+			steps = append(steps, Step{
+				Action: actionFor(exists && role.memberOf[r], ActionUpdate),
+				SQL:    grantRoleSQL(r, user.Name),
+			})
+		}
+	}
+	return steps, nil
+}
+
+// planDatabases plans the statements that create databases and apply
+// database-level grants
+func planDatabases(databases []Database, state *clusterState, opts Options) ([]Step, error) {
+	var steps []Step
+	for _, db := range databases {
+		current, exists := state.databases[db.Name]
+		steps = append(steps, Step{Action: actionFor(exists, ActionCreate), SQL: createDatabaseSQL(db)})
+		if exists {
+			if db.Owner != "" {
+				steps = append(steps, Step{
+					Action: actionFor(current.owner == db.Owner, ActionUpdate),
+					SQL:    alterDatabaseOwnerSQL(db.Name, db.Owner),
+				})
+			}
+			steps = append(steps, planDatabaseProperties(db, current)...)
+		}
+
+		for _, grant := range db.Grants {
+			grantCmd, err := grantDatabaseSQL(grant.Privileges, db.Name, grant.User)
+			if err != nil {
+				return nil, err
+			}
+			privileges := normalizePrivileges(kindDatabase, grant.Privileges)
+			steps = append(steps, Step{
+				Action: actionFor(exists && current.acl.has(grant.User, privileges), ActionUpdate),
+				SQL:    grantCmd,
+			})
+		}
+
+		if opts.Strict && exists {
+			declared := aclSet{}
+			for _, grant := range db.Grants {
+				declared.declare(grant.User, normalizePrivileges(kindDatabase, grant.Privileges))
+			}
+			for _, r := range undeclared(current.acl, declared, current.owner) {
+				if r.grantee == db.Owner {
+					continue
+				}
+				revokeCmd, err := revokeDatabaseSQL(r.privileges, db.Name, r.grantee)
+				if err != nil {
+					return nil, err
+				}
+				steps = append(steps, Step{Action: ActionUpdate, SQL: revokeCmd})
+			}
+		}
+	}
+	return steps, nil
+}
+
+// planTablespaces plans the statements that create tablespaces and bring the
+// owner, options and grants of existing ones in line with the config. In
+// strict mode options and privileges the config doesn't declare are removed.
+func planTablespaces(tablespaces []Tablespace, state *clusterState, opts Options) ([]Step, error) {
+	var steps []Step
+	add := func(action Action, sql string) {
+		steps = append(steps, Step{Action: action, SQL: sql})
+	}
+
+	for _, tablespace := range tablespaces {
+		current, exists := state.tablespaces[tablespace.Name]
+		add(actionFor(exists, ActionCreate), createTablespaceSQL(tablespace))
+		if exists {
+			if tablespace.Owner != "" {
+				add(actionFor(current.owner == tablespace.Owner, ActionUpdate), alterTablespaceOwnerSQL(tablespace.Name, tablespace.Owner))
+			}
+			declared := map[string]bool{}
+			for _, name := range sortedKeys(tablespace.Options) {
+				value := tablespace.Options[name]
+				name = strings.ToLower(name)
+				declared[name] = true
+				add(actionFor(current.options[name] == value, ActionUpdate), setTablespaceOptionSQL(tablespace.Name, name, value))
+			}
+			if opts.Strict {
+				for _, name := range sortedKeys(current.options) {
+					if !declared[name] {
+						add(ActionUpdate, resetTablespaceOptionSQL(tablespace.Name, name))
+					}
+				}
+			}
+		}
+
+		for _, grant := range tablespace.Grants {
+			grantCmd, err := grantTablespaceSQL(grant.Privileges, tablespace.Name, grant.User)
+			if err != nil {
+				return nil, err
+			}
+			privileges := normalizePrivileges(kindTablespace, grant.Privileges)
+			add(actionFor(exists && current.acl.has(grant.User, privileges), ActionUpdate), grantCmd)
+		}
+
+		if opts.Strict && exists {
+			declared := aclSet{}
+			for _, grant := range tablespace.Grants {
+				declared.declare(grant.User, normalizePrivileges(kindTablespace, grant.Privileges))
+			}
+			for _, r := range undeclared(current.acl, declared, current.owner) {
+				if r.grantee == tablespace.Owner {
+					continue
+				}
+				revokeCmd, err := revokeTablespaceSQL(r.privileges, tablespace.Name, r.grantee)
+				if err != nil {
+					return nil, err
+				}
+				add(ActionUpdate, revokeCmd)
+			}
+		}
+	}
+	return steps, nil
+}
+
+// tablespaceDrift reports existing tablespaces in another location than the
+// config declares; a tablespace can't be moved
+func tablespaceDrift(tablespaces []Tablespace, state *clusterState) []string {
+	var drift []string
+	for _, tablespace := range tablespaces {
+		current, exists := state.tablespaces[tablespace.Name]
+		if exists && tablespace.Location != "" && current.location != tablespace.Location {
+			drift = append(drift, fmt.Sprintf("tablespace %s is located in %s, not %s", tablespace.Name, current.location, tablespace.Location))
+		}
+	}
+	return drift
+}
+
+// planDatabaseProperties plans the ALTER DATABASE statements that move the
+// mutable properties of an existing database to the declared values
+func planDatabaseProperties(db Database, current *databaseState) []Step {
+	var steps []Step
+	if db.ConnectionLimit != nil {
+		steps = append(steps, Step{
+			Action: actionFor(current.connLimit == *db.ConnectionLimit, ActionUpdate),
+			SQL:    alterDatabaseSQL(db.Name, fmt.Sprintf("CONNECTION LIMIT %d", *db.ConnectionLimit)),
+		})
+	}
+	if db.AllowConnections != nil {
+		steps = append(steps, Step{
+			Action: actionFor(current.allowConn == *db.AllowConnections, ActionUpdate),
+			SQL:    alterDatabaseSQL(db.Name, fmt.Sprintf("ALLOW_CONNECTIONS %t", *db.AllowConnections)),
+		})
+	}
+	if db.IsTemplate != nil {
+		steps = append(steps, Step{
+			Action: actionFor(current.isTemplate == *db.IsTemplate, ActionUpdate),
+			SQL:    alterDatabaseSQL(db.Name, fmt.Sprintf("IS_TEMPLATE %t", *db.IsTemplate)),
+		})
+	}
+	if db.Tablespace != "" {
+		steps = append(steps, Step{
+			Action: actionFor(current.tablespace == db.Tablespace, ActionUpdate),
+			SQL:    alterDatabaseTablespaceSQL(db.Name, db.Tablespace),
+		})
+	}
+	return steps
+}
+
+// databasePropertyDrift reports existing databases whose encoding, locales or
+// collation version differ from the config. They are fixed when a database
+// is created, so the plan can't correct them.
+func databasePropertyDrift(databases []Database, state *clusterState) []string {
+	var drift []string
+	for _, db := range databases {
+		current, exists := state.databases[db.Name]
+		if !exists {
+			continue
+		}
+		differs := func(property, declared, actual string, same func(a, b string) bool) {
+			switch {
+			case declared == "" || same(declared, actual):
+			case actual == "":
+				drift = append(drift, fmt.Sprintf("database %s has no %s, not %s", db.Name, property, declared))
+			default:
+				drift = append(drift, fmt.Sprintf("database %s has %s %s, not %s", db.Name, property, actual, declared))
+			}
+		}
+		differs("encoding", db.Encoding, current.encoding, sameName)
+		differs("lc_collate", db.LcCollate, current.collate, sameName)
+		differs("lc_ctype", db.LcCtype, current.ctype, sameName)
+		differs("locale_provider", db.LocaleProvider, current.localeProvider, strings.EqualFold)
+		differs("icu_locale", db.IcuLocale, current.icuLocale, sameName)
+		differs("collation_version", db.CollationVersion, current.collationVersion, func(a, b string) bool { return a == b })
+	}
+	return drift
+}
+
+// sameName compares encoding and locale names ignoring case, hyphens and
+// underscores, so UTF-8 matches utf8 and en_US.UTF-8 matches en_US.utf8
+func sameName(a, b string) bool {
+	clean := strings.NewReplacer("-", "", "_", "")
+	return strings.EqualFold(clean.Replace(a), clean.Replace(b))
+}
+
+// planSettings plans the configuration parameters of roles, users, databases
+// and roles in a database, recorded in pg_db_role_setting. In strict mode
+// parameters the config doesn't declare are reset for declared roles, users
+// and databases.
+func planSettings(config *Config, state *clusterState, opts Options) []Step {
+	declared := map[settingKey]map[string]string{}
+	for _, role := range config.Roles {
+		declared[settingKey{role: role.Name}] = role.Settings
+	}
+	for _, user := range config.Users {
+		declared[settingKey{role: user.Name}] = user.Settings
+	}
+	for _, db := range config.Databases {
+		declared[settingKey{database: db.Name}] = db.Settings
+		for role, settings := range db.RoleSettings {
+			declared[settingKey{role: role, database: db.Name}] = settings
+		}
+	}
+	// Settings of roles in declared databases are managed even without an
+	// entry in role_settings
+	databases := map[string]bool{}
+	for _, db := range config.Databases {
+		databases[db.Name] = true
+	}
+	if opts.Strict {
+		for key := range state.settings {
+			if _, ok := declared[key]; !ok && key.role != "" && databases[key.database] {
+				declared[key] = nil
+			}
+		}
+	}
+
+	keys := make([]settingKey, 0, len(declared))
+	for key := range declared {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].database != keys[j].database {
+			return keys[i].database < keys[j].database
+		}
+		return keys[i].role < keys[j].role
+	})
+
+	var steps []Step
+	for _, key := range keys {
+		current := state.settings[key]
+		names := map[string]bool{}
+		for _, name := range sortedKeys(declared[key]) {
+			value := declared[key][name]
+			name = strings.ToLower(name)
+			names[name] = true
+			current, ok := current[name]
+			steps = append(steps, Step{
+				Action: actionFor(ok && current == storedSetting(name, value), ActionUpdate),
+				SQL:    setSettingSQL(key.role, key.database, name, value),
+			})
+		}
+		if opts.Strict {
+			for _, name := range sortedKeys(current) {
+				if !names[name] {
+					steps = append(steps, Step{Action: ActionUpdate, SQL: resetSettingSQL(key.role, key.database, name)})
+				}
+			}
+		}
+	}
+	return steps
+}
+
+// planExtensions plans the statements that create extensions within a database
+// and update existing ones to their pinned version
+func planExtensions(dbName string, extensions []Extension, catalog *databaseCatalog) []Step {
+	var steps []Step
+	for _, extension := range extensions {
+		current := catalog.extensions[extension.Name]
+		step := Step{Action: actionFor(current != nil, ActionCreate), Database: dbName, SQL: createExtensionSQL(extension)}
+		if current != nil && extension.Version != "" && current.version != extension.Version {
+			step = Step{Action: ActionUpdate, Database: dbName, SQL: updateExtensionSQL(extension)}
+		}
+		steps = append(steps, step)
+	}
+	return steps
+}
+
+// extensionDrift describes existing extensions installed in another schema
+// than the config declares; dbstrap doesn't move them
+func extensionDrift(dbName string, extensions []Extension, catalog *databaseCatalog) []string {
+	var drift []string
+	for _, extension := range extensions {
+		current := catalog.extensions[extension.Name]
+		if current != nil && extension.Schema != "" && current.schema != extension.Schema {
+			drift = append(drift, fmt.Sprintf("extension %s in database %s is installed in schema %s, not %s", extension.Name, dbName, current.schema, extension.Schema))
+		}
+	}
+	return drift
+}
+
+// checkExtensions reports extensions, and pinned versions, that the server
+// doesn't provide, so a run stops before changing anything
+func checkExtensions(databases []Database, available map[string]map[string]bool) error {
+	var errs []error
+	for _, db := range databases {
+		for _, extension := range db.Extensions {
+			versions, ok := available[extension.Name]
+			switch {
+			case !ok:
+				errs = append(errs, fmt.Errorf("extension %s for database %s is not available on the server", extension.Name, db.Name))
+			case extension.Version != "" && !versions[extension.Version]:
+				errs = append(errs, fmt.Errorf("version %s of extension %s for database %s is not available on the server; available versions: %s",
+					extension.Version, extension.Name, db.Name, strings.Join(sortedKeys(versions), ", ")))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// allObjectsHave reports whether every existing object of the given kind in
+// the schema grants the privileges to grantee
+func (s *schemaState) allObjectsHave(kind objectKind, grantee string, privileges []string) bool {
+	if s == nil {
+		return true
+	}
+	for _, object := range s.objects[kind] {
+		if !object.acl.has(grantee, privileges) {
+			return false
+		}
+	}
+	return true
+}
+
+// planSchemas plans the statements that create schemas within a database and
+// apply their grants
+func planSchemas(dbName string, schemas []Schema, catalog *databaseCatalog, opts Options) ([]Step, error) {
+	var steps []Step
+	add := func(action Action, sql string) {
+		steps = append(steps, Step{Action: action, Database: dbName, SQL: sql})
+	}
+
+	for _, schema := range schemas {
+		current, exists := catalog.schemas[schema.Name]
+		add(actionFor(exists, ActionCreate), createSchemaSQL(schema))
+		if exists && schema.Owner != "" {
+			add(actionFor(current.owner == schema.Owner, ActionUpdate), alterSchemaOwnerSQL(schema.Name, schema.Owner))
+		}
+		if schema.ReassignObjects && exists {
+			steps = append(steps, planReassignObjects(dbName, schema, current)...)
+		}
+
+		for _, grant := range schema.Grants {
+			grantee, err := schemaGrantee(grant)
+			if err != nil {
+				return nil, err
+			}
+
+			// Schema privileges
+			if len(grant.Privileges) > 0 {
+				grantCmd, err := grantSchemaSQL(grant.Privileges, schema.Name, grantee)
+				if err != nil {
+					return nil, err
+				}
+				privileges := normalizePrivileges(kindSchema, grant.Privileges)
+				add(actionFor(exists && current.acl.has(grantee, privileges), ActionUpdate), grantCmd)
+			}
+
+			// Privileges on existing tables, sequences and functions
+			for _, kind := range []objectKind{kindTable, kindSequence, kindFunction} {
+				declared := grant.allObjectPrivileges(kind)
+				if len(declared) == 0 {
+					continue
+				}
+				grantCmd, err := grantAllInSchemaSQL(declared, kind, schema.Name, grantee)
+				if err != nil {
+					return nil, err
+				}
+				privileges := normalizePrivileges(kind, declared)
+				add(actionFor(current.allObjectsHave(kind, grantee, privileges), ActionUpdate), grantCmd)
+			}
+
+			// Privileges on individual objects; objects that don't exist yet
+			// are skipped until a later run
+			for _, object := range grant.Objects {
+				kind, err := object.kind()
+				if err != nil {
+					return nil, err
+				}
+				var existing *objectState
+				if current != nil {
+					existing = current.objects[kind][catalog.objectKey(schema.Name, object, kind)]
+				}
+				// Functions are named by the identity arguments the server
+				// resolved, not the config's spelling of them
+				args := object.Args
+				if existing != nil && kind == kindFunction {
+					args = existing.args
+				}
+				grantCmd, err := grantObjectSQL(object.Privileges, kind, schema.Name, object.Name, args, grantee)
+				if err != nil {
+					return nil, err
+				}
+				if existing == nil {
+					slog.Warn("Skipping grant on missing object", "database", dbName, "schema", schema.Name, "object", object.key(kind), "grantee", grantee)
+					continue
+				}
+				privileges := normalizePrivileges(kind, object.Privileges)
+				add(actionFor(existing.acl.has(grantee, privileges), ActionUpdate), grantCmd)
+			}
+
+			// Default privileges for future objects created by each creator role
+			for _, creator := range schema.defaultCreators(grant, catalog) {
+				for _, kind := range defaultPrivilegeKinds {
+					declared := grant.defaultPrivileges(kind)
+					if len(declared) == 0 {
+						continue
+					}
+					grantCmd, err := defaultPrivilegesSQL(creator, schema.Name, declared, kind, grantee)
+					if err != nil {
+						return nil, err
+					}
+					privileges := normalizePrivileges(kind, declared)
+					key := defaultACLKey{forRole: creator, schema: schema.Name, kind: kind}
+					add(actionFor(catalog.defaultACLs[key].has(grantee, privileges), ActionUpdate), grantCmd)
+				}
+			}
+		}
+
+		columnSteps, err := planColumnGrants(dbName, schema, current)
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, columnSteps...)
+
+		if opts.Strict && exists {
+			revokes, err := planSchemaRevokes(dbName, schema, current, catalog)
+			if err != nil {
+				return nil, err
+			}
+			steps = append(steps, revokes...)
+		}
+
+		rlsSteps, err := planRowSecurity(dbName, schema, current, catalog.expressions, opts)
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, rlsSteps...)
+	}
+	return steps, nil
+}
+
+// planRowSecurity plans the row-level security flags and policies of the
+// tables in a schema. A policy whose command or kind changed, or that lost a
+// clause, can't be altered and is dropped and created again. Policies whose
+// expressions can't be shown to match are altered. In strict mode policies
+// the config doesn't declare are dropped from declared tables.
+func planRowSecurity(dbName string, schema Schema, current *schemaState, expressions map[expressionKey]string, opts Options) ([]Step, error) {
+	var steps []Step
+	add := func(action Action, sql string) {
+		steps = append(steps, Step{Action: action, Database: dbName, SQL: sql})
+	}
+
+	for _, rls := range schema.RowSecurity {
+		for _, policy := range rls.Policies {
+			if err := policy.validate(); err != nil {
+				return nil, fmt.Errorf("table %s.%s: %w", schema.Name, rls.Table, err)
+			}
+		}
+
+		var table *objectState
+		if current != nil {
+			table = current.objects[kindTable][rls.Table]
+		}
+		if table == nil {
+			slog.Warn("Skipping row security on missing table", "database", dbName, "schema", schema.Name, "table", rls.Table)
+			continue
+		}
+
+		if rls.Enable != nil {
+			add(actionFor(table.rowSecurity == *rls.Enable, ActionUpdate), rowSecuritySQL(schema.Name, rls.Table, *rls.Enable))
+		}
+		if rls.Force != nil {
+			add(actionFor(table.forceRowSecurity == *rls.Force, ActionUpdate), forceRowSecuritySQL(schema.Name, rls.Table, *rls.Force))
+		}
+
+		declared := map[string]bool{}
+		for _, policy := range rls.Policies {
+			declared[policy.Name] = true
+			existing := table.policies[policy.Name]
+			switch {
+			case existing == nil:
+				add(ActionCreate, createPolicySQL(schema.Name, rls.Table, policy))
+			case existing.command != policy.command() || existing.restrictive != policy.Restrictive ||
+				(existing.using != "" && policy.Using == "") || (existing.withCheck != "" && policy.WithCheck == ""):
+				add(ActionDrop, dropPolicySQL(schema.Name, rls.Table, policy.Name))
+				add(ActionCreate, createPolicySQL(schema.Name, rls.Table, policy))
+			default:
+				sameExpression := func(configured, existing string) bool {
+					if configured == "" || existing == "" {
+						return configured == existing
+					}
+					if deparsed, ok := expressions[expressionKey{schema.Name, rls.Table, configured}]; ok {
+						return deparsed == existing
+					}
+					return normalizeExpression(configured) == normalizeExpression(existing)
+				}
+				same := strings.Join(existing.roles, ",") == strings.Join(policy.roles(), ",") &&
+					sameExpression(policy.Using, existing.using) &&
+					sameExpression(policy.WithCheck, existing.withCheck)
+				add(actionFor(same, ActionUpdate), alterPolicySQL(schema.Name, rls.Table, policy))
+			}
+		}
+
+		if opts.Strict {
+			for _, name := range sortedKeys(table.policies) {
+				if !declared[name] {
+					add(ActionDrop, dropPolicySQL(schema.Name, rls.Table, name))
+				}
+			}
+		}
+	}
+	return steps, nil
+}
+
+// normalizeExpression folds the layout of a policy expression for when the
+// server couldn't deparse the configured version: outside quotes, runs of
+// whitespace become one space, spaces inside parentheses are dropped and
+// keywords and identifiers are lowercased. Parentheses and quoted text are
+// kept as written, so only expressions that differ in layout compare equal.
+func normalizeExpression(expr string) string {
+	var b strings.Builder
+	var quote, last rune
+	space := false
+	for _, r := range strings.TrimSpace(expr) {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case unicode.IsSpace(r):
+			space = true
+			continue
+		case r == '\'' || r == '"':
+			quote = r
+		default:
+			r = unicode.ToLower(r)
+		}
+		if space && last != '(' && r != ')' {
+			b.WriteRune(' ')
+		}
+		space = false
+		b.WriteRune(r)
+		last = r
+	}
+	return b.String()
+}
+
+// objectKey returns the catalog key of the object a grant names. Functions
+// are looked up by the signature the server resolved their arguments to.
+func (c *databaseCatalog) objectKey(schema string, object ObjectGrant, kind objectKind) string {
+	if kind == kindFunction {
+		if key, ok := c.functions[functionKey{schema, object.Name, object.Args}]; ok {
+			return key
+		}
+	}
+	return object.key(kind)
+}
+
+// schemaOwner returns the role that owns the schema after the plan runs
+func schemaOwner(schema Schema, current *schemaState) string {
+	if schema.Owner == "" && current != nil {
+		return current.owner
+	}
+	return schema.Owner
+}
+
+// reassigned reports whether the plan makes the schema owner the owner of
+// object
+func reassigned(schema Schema, object *objectState) bool {
+	return schema.ReassignObjects && !object.linked && !object.extension
+}
+
+// planReassignObjects plans giving every table, view, sequence and function in
+// an existing schema to the schema owner. Sequences that belong to a table
+// column follow the table, and objects that belong to an extension are left
+// alone.
+func planReassignObjects(dbName string, schema Schema, current *schemaState) []Step {
+	owner := schemaOwner(schema, current)
+	var steps []Step
+	for _, kind := range []objectKind{kindTable, kindSequence, kindFunction} {
+		objects := current.objects[kind]
+		for _, key := range sortedKeys(objects) {
+			object := objects[key]
+			if !reassigned(schema, object) || object.owner == owner {
+				continue
+			}
+			name := strings.TrimSuffix(key, "("+object.args+")")
+			steps = append(steps, Step{
+				Action:   ActionUpdate,
+				Database: dbName,
+				SQL:      alterObjectOwnerSQL(object.relkind, schema.Name, name, object.args, owner),
+			})
+		}
+	}
+	return steps
+}
+
+// planColumnGrants plans the column grants of a schema. Grants on tables that
+// don't exist yet are skipped with a warning; they apply on a later run.
+func planColumnGrants(dbName string, schema Schema, current *schemaState) ([]Step, error) {
+	var steps []Step
+	for _, grant := range schema.ColumnGrants {
+		grantee, err := grant.grantee()
+		if err != nil {
+			return nil, err
+		}
+		grantCmd, err := grantColumnsSQL(grant.Privileges, schema.Name, grant.Table, grant.Columns, grantee)
+		if err != nil {
+			return nil, err
+		}
+
+		var table *objectState
+		if current != nil {
+			table = current.objects[kindTable][grant.Table]
+		}
+		if table == nil {
+			slog.Warn("Skipping column grant on missing table", "database", dbName, "schema", schema.Name, "table", grant.Table, "grantee", grantee)
+			continue
+		}
+
+		privileges := normalizePrivileges(kindColumn, grant.Privileges)
+		granted := true
+		for _, column := range grant.Columns {
+			granted = granted && table.columns[column].has(grantee, privileges)
+		}
+		steps = append(steps, Step{Action: actionFor(granted, ActionUpdate), Database: dbName, SQL: grantCmd})
+	}
+	return steps, nil
+}
+
+// schemaACLs is everything a schema's grants declare: privileges on the schema
+// itself, on existing objects of each kind and default privileges
+type schemaACLs struct {
+	schema   aclSet
+	objects  map[objectKind]aclSet
+	defaults map[defaultACLKey]aclSet
+	// named holds grants on individual objects, keyed by catalog name
+	named map[objectKind]map[string]aclSet
+	// columns is keyed by table and column
+	columns map[string]map[string]aclSet
+}
+
+// declaredSchemaACLs collects the privileges the grants of schema declare
+func declaredSchemaACLs(schema Schema, catalog *databaseCatalog) (*schemaACLs, error) {
+	declared := &schemaACLs{
+		schema:   aclSet{},
+		objects:  map[objectKind]aclSet{},
+		defaults: map[defaultACLKey]aclSet{},
+		named:    map[objectKind]map[string]aclSet{},
+		columns:  map[string]map[string]aclSet{},
+	}
+	for _, grant := range schema.Grants {
+		grantee, err := schemaGrantee(grant)
+		if err != nil {
+			return nil, err
+		}
+		declared.schema.declare(grantee, normalizePrivileges(kindSchema, grant.Privileges))
+		for _, kind := range []objectKind{kindTable, kindSequence, kindFunction} {
+			if declared.objects[kind] == nil {
+				declared.objects[kind] = aclSet{}
+			}
+			declared.objects[kind].declare(grantee, normalizePrivileges(kind, grant.allObjectPrivileges(kind)))
+		}
+		for _, object := range grant.Objects {
+			kind, err := object.kind()
+			if err != nil {
+				return nil, err
+			}
+			if declared.named[kind] == nil {
+				declared.named[kind] = map[string]aclSet{}
+			}
+			key := catalog.objectKey(schema.Name, object, kind)
+			if declared.named[kind][key] == nil {
+				declared.named[kind][key] = aclSet{}
+			}
+			declared.named[kind][key].declare(grantee, normalizePrivileges(kind, object.Privileges))
+		}
+		for _, creator := range schema.defaultCreators(grant, catalog) {
+			for _, kind := range defaultPrivilegeKinds {
+				key := defaultACLKey{forRole: creator, schema: schema.Name, kind: kind}
+				if declared.defaults[key] == nil {
+					declared.defaults[key] = aclSet{}
+				}
+				declared.defaults[key].declare(grantee, normalizePrivileges(kind, grant.defaultPrivileges(kind)))
+			}
+		}
+	}
+	for _, grant := range schema.ColumnGrants {
+		grantee, err := grant.grantee()
+		if err != nil {
+			return nil, err
+		}
+		if declared.columns[grant.Table] == nil {
+			declared.columns[grant.Table] = map[string]aclSet{}
+		}
+		for _, column := range grant.Columns {
+			if declared.columns[grant.Table][column] == nil {
+				declared.columns[grant.Table][column] = aclSet{}
+			}
+			declared.columns[grant.Table][column].declare(grantee, normalizePrivileges(kindColumn, grant.Privileges))
+		}
+	}
+	return declared, nil
+}
+
+// planSchemaRevokes plans the statements that revoke privileges on an existing
+// schema, its objects and its default privileges that the config doesn't
+// declare
+func planSchemaRevokes(dbName string, schema Schema, current *schemaState, catalog *databaseCatalog) ([]Step, error) {
+	declared, err := declaredSchemaACLs(schema, catalog)
+	if err != nil {
+		return nil, err
+	}
+
+	var steps []Step
+	add := func(sql string, err error) error {
+		if err != nil {
+			return err
+		}
+		steps = append(steps, Step{Action: ActionUpdate, Database: dbName, SQL: sql})
+		return nil
+	}
+
+	// Owners keep their implicit privileges, including roles the plan makes
+	// owners
+	owner := schemaOwner(schema, current)
+	for _, r := range undeclared(current.acl, declared.schema, current.owner) {
+		if r.grantee == owner {
+			continue
+		}
+		if err := add(revokeSchemaSQL(r.privileges, schema.Name, r.grantee)); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, kind := range []objectKind{kindTable, kindSequence, kindFunction} {
+		objects := current.objects[kind]
+		for _, name := range sortedKeys(objects) {
+			object := objects[name]
+			// Extension members keep their privileges unless the config names
+			// them in an object grant
+			if object.extension && declared.named[kind][name] == nil {
+				continue
+			}
+			objectName := strings.TrimSuffix(name, "("+object.args+")")
+			objectACL := mergeACLs(declared.objects[kind], declared.named[kind][name])
+			for _, r := range undeclared(object.acl, objectACL, object.owner) {
+				if reassigned(schema, object) && r.grantee == owner {
+					continue
+				}
+				if err := add(revokeObjectSQL(r.privileges, kind, schema.Name, objectName, object.args, r.grantee)); err != nil {
+					return nil, err
+				}
+			}
+			for _, column := range sortedKeys(object.columns) {
+				for _, r := range undeclared(object.columns[column], declared.columns[name][column], "") {
+					if err := add(revokeColumnsSQL(r.privileges, schema.Name, name, []string{column}, r.grantee)); err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+	}
+
+	keys := make([]defaultACLKey, 0, len(catalog.defaultACLs))
+	for key := range catalog.defaultACLs {
+		if key.schema == schema.Name {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].forRole != keys[j].forRole {
+			return keys[i].forRole < keys[j].forRole
+		}
+		return keys[i].kind < keys[j].kind
+	})
+	for _, key := range keys {
+		for _, r := range undeclared(catalog.defaultACLs[key], declared.defaults[key], "") {
+			if err := add(revokeDefaultPrivilegesSQL(key.forRole, schema.Name, r.privileges, key.kind, r.grantee)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return steps, nil
+}
+
+// mergeACLs returns the privileges granted by either set
+func mergeACLs(a, b aclSet) aclSet {
+	merged := aclSet{}
+	for _, acl := range []aclSet{a, b} {
+		for grantee, privileges := range acl {
+			merged.declare(grantee, sortedKeys(privileges))
+		}
+	}
+	return merged
+}
+
+// revocation is a set of privileges to revoke from one grantee
+type revocation struct {
+	grantee    string
+	privileges []string
+}
+
+// undeclared returns the privileges in acl that declared doesn't grant, sorted
+// by grantee. The owner's privileges are implicit and never revoked.
+func undeclared(acl, declared aclSet, owner string) []revocation {
+	var result []revocation
+	for _, grantee := range sortedKeys(acl) {
+		if grantee == owner {
+			continue
+		}
+		var privileges []string
+		for _, p := range sortedKeys(acl[grantee]) {
+			if !declared[grantee][p] {
+				privileges = append(privileges, p)
+			}
+		}
+		if len(privileges) > 0 {
+			result = append(result, revocation{grantee: grantee, privileges: privileges})
+		}
+	}
+	return result
+}
+
+// sortedKeys returns the keys of m in ascending order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,762 @@
+package dbstrap
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+// TestPlanUsers tests that existing roles and memberships are reported as no-ops
+func TestPlanUsers(t *testing.T) {
+	state := newClusterState()
+	state.roles["existing_user"] = &roleState{canLogin: true, memberOf: map[string]bool{"readonly_role": true}}
+
+	users := []User{
+		{Name: "existing_user", CanLogin: true, Password: "secret", Roles: []string{"readonly_role", "writer_role"}},
+		{Name: "new_user", CanLogin: true, Password: "secret"},
+	}
+
+	steps, err := planUsers(users, state)
+	require.NoError(t, err)
+	require.Len(t, steps, 4)
+	assert.Equal(t, ActionNoop, steps[0].Action)
+	assert.Equal(t, ActionNoop, steps[1].Action)
+	assert.Equal(t, "GRANT readonly_role TO existing_user", steps[1].SQL)
+	assert.Equal(t, ActionUpdate, steps[2].Action)
+	assert.Equal(t, ActionCreate, steps[3].Action)
+	assert.Contains(t, steps[3].SQL, "'secret'")
+	assert.NotContains(t, steps[3].String(), "secret")
+}
+
+// TestPlanDatabases tests database creation and grant detection
+func TestPlanDatabases(t *testing.T) {
+	state := newClusterState()
+	state.databases["app"] = &databaseState{owner: "app_user", acl: aclSet{}}
+	state.databases["app"].acl.add("app_user", "CONNECT")
+
+	databases := []Database{
+		{
+			Name:  "app",
+			Owner: "app_user",
+			Grants: []DatabaseGrant{
+				{User: "app_user", Privileges: []string{"connect"}},
+				{User: "reader", Privileges: []string{"CONNECT", "TEMP"}},
+			},
+		},
+		{Name: "reports", Owner: "app_user", Encoding: "UTF8"},
+	}
+
+	steps, err := planDatabases(databases, state, Options{})
+	require.NoError(t, err)
+	require.Len(t, steps, 5)
+	assert.Equal(t, ActionNoop, steps[0].Action)
+	assert.Equal(t, ActionNoop, steps[1].Action, "the owner already matches")
+	assert.Equal(t, ActionNoop, steps[2].Action)
+	assert.Equal(t, ActionUpdate, steps[3].Action)
+	assert.Equal(t, ActionCreate, steps[4].Action)
+	assert.Equal(t, "CREATE DATABASE reports OWNER app_user ENCODING 'UTF8'", steps[4].SQL)
+}
+
+// TestPlanSchemas tests schema creation, object grants and default privileges
+func TestPlanSchemas(t *testing.T) {
+	catalog := newDatabaseCatalog()
+	catalog.extensions["uuid-ossp"] = &extensionState{version: "1.1", schema: "public"}
+	existing := &schemaState{owner: "app_user", acl: aclSet{}, objects: map[objectKind]map[string]*objectState{}}
+	existing.acl.add("reader", "USAGE")
+	existing.objects[kindTable] = map[string]*objectState{"a": {acl: aclSet{}}, "b": {acl: aclSet{}}}
+	existing.objects[kindTable]["a"].acl.add("reader", "SELECT")
+	existing.objects[kindTable]["b"].acl.add("reader", "SELECT")
+	existing.objects[kindSequence] = map[string]*objectState{"a_id_seq": {acl: aclSet{}}}
+	catalog.schemas["app"] = existing
+	catalog.defaultACLs[defaultACLKey{forRole: "app_user", schema: "app", kind: kindTable}] = aclSet{}
+
+	schemas := []Schema{
+		{
+			Name:  "app",
+			Owner: "app_user",
+			Grants: []SchemaGrant{{
+				Role:               "reader",
+				Privileges:         []string{"USAGE"},
+				TablePrivileges:    []string{"SELECT"},
+				SequencePrivileges: []string{"SELECT"},
+				DefaultPrivileges:  []string{"SELECT"},
+			}},
+		},
+		{
+			Name:   "audit",
+			Owner:  "app_user",
+			Grants: []SchemaGrant{{Role: "reader", TablePrivileges: []string{"SELECT"}}},
+		},
+	}
+
+	steps, err := planSchemas("app_db", schemas, catalog, Options{})
+	require.NoError(t, err)
+	require.Len(t, steps, 8)
+	assert.Equal(t, ActionNoop, steps[0].Action)
+	assert.Equal(t, "ALTER SCHEMA app OWNER TO app_user", steps[1].SQL)
+	assert.Equal(t, ActionNoop, steps[1].Action)
+	assert.Equal(t, ActionNoop, steps[2].Action)
+	assert.Equal(t, ActionNoop, steps[3].Action, "every table already grants SELECT")
+	assert.Equal(t, ActionUpdate, steps[4].Action, "the sequence lacks SELECT")
+	assert.Equal(t, ActionUpdate, steps[5].Action)
+	assert.Equal(t, "ALTER DEFAULT PRIVILEGES FOR ROLE app_user IN SCHEMA app GRANT SELECT ON TABLES TO reader", steps[5].SQL)
+	assert.Equal(t, ActionCreate, steps[6].Action)
+	assert.Equal(t, ActionNoop, steps[7].Action, "a new schema has no tables to grant on")
+	for _, step := range steps {
+		assert.Equal(t, "app_db", step.Database)
+	}
+
+	_, err = planSchemas("app_db", []Schema{{Name: "bad", Grants: []SchemaGrant{{Privileges: []string{"USAGE"}}}}}, catalog, Options{})
+	assert.Error(t, err)
+}
+
+// TestPlanWrite tests the plan output format
+func TestPlanWrite(t *testing.T) {
+	plan := &Plan{Steps: []Step{
+		{Action: ActionCreate, SQL: "CREATE ROLE app WITH LOGIN PASSWORD 'x'", Redacted: "CREATE ROLE app WITH LOGIN PASSWORD '********'"},
+		{Action: ActionNoop, Database: "app", SQL: `CREATE EXTENSION IF NOT EXISTS "uuid-ossp"`},
+		{Action: ActionUpdate, Database: "app", SQL: "GRANT USAGE ON SCHEMA app TO reader"},
+	}}
+
+	var buf bytes.Buffer
+	require.NoError(t, plan.Write(&buf))
+	assert.Equal(t, `-- cluster
+create  CREATE ROLE app WITH LOGIN PASSWORD '********';
+-- database app
+no-op   CREATE EXTENSION IF NOT EXISTS "uuid-ossp";
+update  GRANT USAGE ON SCHEMA app TO reader;
+Plan: 1 to create, 1 to update, 1 unchanged.
+`, buf.String())
+}
+
+// TestPlanUsersAttributes tests that role attributes are set on creation and
+// reconciled on existing roles
+func TestPlanUsersAttributes(t *testing.T) {
+	yes, no, limit := true, false, 5
+	attrs := RoleAttributes{CreateDB: &yes, Inherit: &no, ConnectionLimit: &limit, ValidUntil: "2030-01-01"}
+
+	state := newClusterState()
+	state.roles["existing"] = &roleState{canLogin: true, inherit: true, connLimit: 5, validUntil: "2030-01-01T00:00:00Z", memberOf: map[string]bool{}}
+	state.roles["in_sync"] = &roleState{canLogin: true, createDB: true, connLimit: 5, validUntil: "2030-01-01T00:00:00Z", memberOf: map[string]bool{}}
+
+	users := []User{
+		{Name: "new_user", CanLogin: true, Password: "pw", RoleAttributes: attrs},
+		{Name: "existing", CanLogin: true, RoleAttributes: attrs},
+		{Name: "in_sync", CanLogin: true, RoleAttributes: attrs},
+	}
+
+	steps, err := planUsers(users, state)
+	require.NoError(t, err)
+	require.Len(t, steps, 4)
+	assert.Equal(t, "CREATE ROLE new_user WITH LOGIN CREATEDB NOINHERIT CONNECTION LIMIT 5 VALID UNTIL '2030-01-01T00:00:00Z' PASSWORD 'pw'", steps[0].SQL)
+	assert.Equal(t, ActionNoop, steps[1].Action)
+	assert.Equal(t, ActionUpdate, steps[2].Action)
+	assert.Equal(t, "ALTER ROLE existing WITH CREATEDB NOINHERIT", steps[2].SQL)
+	assert.Equal(t, ActionNoop, steps[3].Action, "roles already in sync need no ALTER")
+}
+
+// TestPlanRoles tests that group roles are created before their memberships
+func TestPlanRoles(t *testing.T) {
+	state := newClusterState()
+	state.roles["legacy_group"] = &roleState{canLogin: true, inherit: true, connLimit: -1, memberOf: map[string]bool{}}
+
+	roles := []Role{
+		{Name: "app_readwrite", Roles: []string{"app_readonly"}},
+		{Name: "app_readonly"},
+		{Name: "legacy_group"},
+	}
+
+	steps, err := planRoles(roles, state)
+	require.NoError(t, err)
+	require.Len(t, steps, 5)
+	assert.Equal(t, "CREATE ROLE app_readwrite", steps[0].SQL)
+	assert.Equal(t, "CREATE ROLE app_readonly", steps[1].SQL)
+	assert.Equal(t, ActionNoop, steps[2].Action)
+	assert.Equal(t, "ALTER ROLE legacy_group WITH NOLOGIN", steps[3].SQL)
+	assert.Equal(t, "GRANT app_readonly TO app_readwrite", steps[4].SQL)
+}
+
+// TestPlanSchemasOwnership tests that existing schemas are transferred to
+// their owner
+func TestPlanSchemasOwnership(t *testing.T) {
+	catalog := newDatabaseCatalog()
+	catalog.schemas["public"] = &schemaState{owner: "postgres", acl: aclSet{}}
+	catalog.schemas["app"] = &schemaState{owner: "app_user", acl: aclSet{}}
+
+	schemas := []Schema{
+		{Name: "public", Owner: "app_user"},
+		{Name: "app", Owner: "app_user"},
+	}
+
+	steps, err := planSchemas("app_db", schemas, catalog, Options{})
+	require.NoError(t, err)
+	require.Len(t, steps, 4)
+	assert.Equal(t, ActionUpdate, steps[1].Action)
+	assert.Equal(t, "ALTER SCHEMA public OWNER TO app_user", steps[1].SQL)
+	assert.Equal(t, ActionNoop, steps[3].Action)
+}
+
+// TestPlanStrict tests that strict mode revokes undeclared privileges on
+// databases, schemas, objects and default privileges
+func TestPlanStrict(t *testing.T) {
+	strict := Options{Strict: true}
+
+	state := newClusterState()
+	state.databases["app"] = &databaseState{owner: "app_user", acl: aclSet{}}
+	state.databases["app"].acl.declare("app_user", []string{"CREATE", "CONNECT", "TEMPORARY"})
+	state.databases["app"].acl.declare("PUBLIC", []string{"CONNECT", "TEMPORARY"})
+	state.databases["app"].acl.declare("reader", []string{"CONNECT"})
+
+	databases := []Database{{
+		Name:   "app",
+		Owner:  "app_user",
+		Grants: []DatabaseGrant{{User: "reader", Privileges: []string{"CONNECT"}}},
+	}}
+
+	steps, err := planDatabases(databases, state, strict)
+	require.NoError(t, err)
+	require.Len(t, steps, 4)
+	assert.Equal(t, "REVOKE CONNECT, TEMPORARY ON DATABASE app FROM PUBLIC", steps[3].SQL)
+
+	steps, err = planDatabases(databases, state, Options{})
+	require.NoError(t, err)
+	assert.Len(t, steps, 3, "nothing is revoked without strict mode")
+
+	catalog := newDatabaseCatalog()
+	schema := &schemaState{owner: "app_user", acl: aclSet{}, objects: map[objectKind]map[string]*objectState{}}
+	schema.acl.declare("app_user", []string{"USAGE", "CREATE"})
+	schema.acl.declare("reader", []string{"USAGE", "CREATE"})
+	schema.objects[kindTable] = map[string]*objectState{"orders": {owner: "app_user", acl: aclSet{}}}
+	schema.objects[kindTable]["orders"].acl.declare("app_user", []string{"SELECT", "INSERT"})
+	schema.objects[kindTable]["orders"].acl.declare("reader", []string{"SELECT", "DELETE"})
+	schema.objects[kindFunction] = map[string]*objectState{"total(integer)": {owner: "app_user", args: "integer", acl: aclSet{}}}
+	schema.objects[kindFunction]["total(integer)"].acl.declare("PUBLIC", []string{"EXECUTE"})
+	catalog.schemas["app"] = schema
+	catalog.defaultACLs[defaultACLKey{forRole: "app_user", schema: "app", kind: kindTable}] = aclSet{"reader": {"SELECT": true, "UPDATE": true}}
+	catalog.defaultACLs[defaultACLKey{forRole: "migrator", schema: "app", kind: kindSequence}] = aclSet{"reader": {"USAGE": true}}
+	catalog.defaultACLs[defaultACLKey{forRole: "migrator", schema: "other", kind: kindSequence}] = aclSet{"reader": {"USAGE": true}}
+
+	schemas := []Schema{{
+		Name:  "app",
+		Owner: "app_user",
+		Grants: []SchemaGrant{{
+			Role:              "reader",
+			Privileges:        []string{"USAGE"},
+			TablePrivileges:   []string{"SELECT"},
+			DefaultPrivileges: []string{"SELECT"},
+		}},
+	}}
+
+	steps, err = planSchemas("app_db", schemas, catalog, strict)
+	require.NoError(t, err)
+	var revokes []string
+	for _, step := range steps {
+		if strings.Contains(step.SQL, "REVOKE") {
+			revokes = append(revokes, step.SQL)
+		}
+	}
+	assert.Equal(t, []string{
+		"REVOKE CREATE ON SCHEMA app FROM reader",
+		"REVOKE DELETE ON TABLE app.orders FROM reader",
+		"REVOKE EXECUTE ON FUNCTION app.total(integer) FROM PUBLIC",
+		"ALTER DEFAULT PRIVILEGES FOR ROLE app_user IN SCHEMA app REVOKE UPDATE ON TABLES FROM reader",
+		"ALTER DEFAULT PRIVILEGES FOR ROLE migrator IN SCHEMA app REVOKE USAGE ON SEQUENCES FROM reader",
+	}, revokes)
+}
+
+// TestPlanSchemasDefaultPrivileges tests default privileges for every object
+// class
+func TestPlanSchemasDefaultPrivileges(t *testing.T) {
+	catalog := newDatabaseCatalog()
+	catalog.schemas["app"] = &schemaState{owner: "app_user", acl: aclSet{}}
+	catalog.defaultACLs[defaultACLKey{forRole: "app_user", schema: "app", kind: kindSequence}] = aclSet{"reader": {"USAGE": true, "SELECT": true}}
+
+	schemas := []Schema{{
+		Name:  "app",
+		Owner: "app_user",
+		Grants: []SchemaGrant{{
+			Role:                      "reader",
+			DefaultPrivileges:         []string{"SELECT"},
+			DefaultSequencePrivileges: []string{"USAGE", "SELECT"},
+			DefaultFunctionPrivileges: []string{"EXECUTE"},
+			DefaultTypePrivileges:     []string{"USAGE"},
+		}},
+	}}
+
+	steps, err := planSchemas("app_db", schemas, catalog, Options{})
+	require.NoError(t, err)
+	require.Len(t, steps, 6)
+	assert.Equal(t, "ALTER DEFAULT PRIVILEGES FOR ROLE app_user IN SCHEMA app GRANT SELECT ON TABLES TO reader", steps[2].SQL)
+	assert.Equal(t, ActionNoop, steps[3].Action)
+	assert.Equal(t, "ALTER DEFAULT PRIVILEGES FOR ROLE app_user IN SCHEMA app GRANT EXECUTE ON FUNCTIONS TO reader", steps[4].SQL)
+	assert.Equal(t, "ALTER DEFAULT PRIVILEGES FOR ROLE app_user IN SCHEMA app GRANT USAGE ON TYPES TO reader", steps[5].SQL)
+
+	_, err = planSchemas("app_db", []Schema{{
+		Name:   "app",
+		Grants: []SchemaGrant{{Role: "reader", DefaultTypePrivileges: []string{"SELECT"}}},
+	}}, catalog, Options{})
+	assert.Error(t, err)
+}
+
+// TestPlanSchemasDefaultCreator tests that default privileges of a schema
+// without an owner name the role that owns or creates it
+func TestPlanSchemasDefaultCreator(t *testing.T) {
+	catalog := newDatabaseCatalog()
+	catalog.currentUser = "postgres"
+	catalog.schemas["app"] = &schemaState{owner: "migrator", acl: aclSet{}}
+	catalog.schemas["app"].acl.declare("reader", []string{"USAGE"})
+	catalog.defaultACLs[defaultACLKey{forRole: "migrator", schema: "app", kind: kindTable}] = aclSet{"reader": {"SELECT": true}}
+
+	grants := []SchemaGrant{{Role: "reader", Privileges: []string{"USAGE"}, DefaultPrivileges: []string{"SELECT"}}}
+	steps, err := planSchemas("app_db", []Schema{
+		{Name: "app", Grants: grants},
+		{Name: "reports", Grants: grants},
+	}, catalog, Options{Strict: true})
+	require.NoError(t, err)
+	var got []string
+	for _, step := range steps {
+		got = append(got, string(step.Action)+" "+step.SQL)
+	}
+	assert.Equal(t, []string{
+		"no-op CREATE SCHEMA IF NOT EXISTS app",
+		"no-op GRANT USAGE ON SCHEMA app TO reader",
+		"no-op ALTER DEFAULT PRIVILEGES FOR ROLE migrator IN SCHEMA app GRANT SELECT ON TABLES TO reader",
+		"create CREATE SCHEMA IF NOT EXISTS reports",
+		"update GRANT USAGE ON SCHEMA reports TO reader",
+		"update ALTER DEFAULT PRIVILEGES FOR ROLE postgres IN SCHEMA reports GRANT SELECT ON TABLES TO reader",
+	}, got)
+}
+
+// TestPlanSchemasForRoles tests one ALTER DEFAULT PRIVILEGES per creator role
+func TestPlanSchemasForRoles(t *testing.T) {
+	catalog := newDatabaseCatalog()
+	catalog.schemas["app"] = &schemaState{owner: "app_owner", acl: aclSet{}}
+	catalog.defaultACLs[defaultACLKey{forRole: "migrator", schema: "app", kind: kindTable}] = aclSet{"reader": {"SELECT": true}}
+	catalog.defaultACLs[defaultACLKey{forRole: "etl", schema: "app", kind: kindTable}] = aclSet{"reader": {"SELECT": true, "DELETE": true}}
+
+	schemas := []Schema{{
+		Name:     "app",
+		Owner:    "app_owner",
+		ForRoles: []string{"app_owner", "migrator"},
+		Grants: []SchemaGrant{
+			{Role: "reader", DefaultPrivileges: []string{"SELECT"}},
+			{Role: "reporting", ForRoles: []string{"etl"}, DefaultPrivileges: []string{"SELECT"}},
+		},
+	}}
+
+	steps, err := planSchemas("app_db", schemas, catalog, Options{Strict: true})
+	require.NoError(t, err)
+	var sql []string
+	for _, step := range steps[1:] {
+		sql = append(sql, string(step.Action)+" "+step.SQL)
+	}
+	assert.Equal(t, []string{
+		"no-op ALTER SCHEMA app OWNER TO app_owner",
+		"update ALTER DEFAULT PRIVILEGES FOR ROLE app_owner IN SCHEMA app GRANT SELECT ON TABLES TO reader",
+		"no-op ALTER DEFAULT PRIVILEGES FOR ROLE migrator IN SCHEMA app GRANT SELECT ON TABLES TO reader",
+		"update ALTER DEFAULT PRIVILEGES FOR ROLE etl IN SCHEMA app GRANT SELECT ON TABLES TO reporting",
+		"update ALTER DEFAULT PRIVILEGES FOR ROLE etl IN SCHEMA app REVOKE DELETE, SELECT ON TABLES FROM reader",
+	}, sql)
+}
+
+// TestPlanColumnGrants tests column grants, skipping tables that don't exist
+// and revoking undeclared column privileges in strict mode
+func TestPlanColumnGrants(t *testing.T) {
+	catalog := newDatabaseCatalog()
+	schema := &schemaState{owner: "app_user", acl: aclSet{}, objects: map[objectKind]map[string]*objectState{}}
+	schema.objects[kindTable] = map[string]*objectState{
+		"customers": {owner: "app_user", acl: aclSet{}, columns: map[string]aclSet{
+			"id":      {"analytics": {"SELECT": true}},
+			"country": {},
+			"email":   {"analytics": {"SELECT": true}},
+		}},
+	}
+	catalog.schemas["app"] = schema
+
+	schemas := []Schema{{
+		Name: "app",
+		ColumnGrants: []ColumnGrant{
+			{Table: "customers", Columns: []string{"id"}, Role: "analytics", Privileges: []string{"SELECT"}},
+			{Table: "customers", Columns: []string{"id", "country"}, Role: "analytics", Privileges: []string{"SELECT"}},
+			{Table: "orders", Columns: []string{"total"}, Role: "analytics", Privileges: []string{"SELECT"}},
+		},
+	}}
+
+	steps, err := planSchemas("app_db", schemas, catalog, Options{Strict: true})
+	require.NoError(t, err)
+	require.Len(t, steps, 4, "the grant on the missing orders table is skipped")
+	assert.Equal(t, ActionNoop, steps[1].Action)
+	assert.Equal(t, ActionUpdate, steps[2].Action)
+	assert.Equal(t, "GRANT SELECT (id, country) ON TABLE app.customers TO analytics", steps[2].SQL)
+	assert.Equal(t, "REVOKE SELECT (email) ON TABLE app.customers FROM analytics", steps[3].SQL)
+
+	_, err = planSchemas("app_db", []Schema{{
+		Name:         "app",
+		ColumnGrants: []ColumnGrant{{Table: "customers", Columns: []string{"id"}, Role: "analytics", Privileges: []string{"DELETE"}}},
+	}}, catalog, Options{})
+	assert.Error(t, err)
+}
+
+// TestPlanObjectGrants tests grants on individual tables and functions
+func TestPlanObjectGrants(t *testing.T) {
+	catalog := newDatabaseCatalog()
+	schema := &schemaState{owner: "app_user", acl: aclSet{}, objects: map[objectKind]map[string]*objectState{}}
+	schema.objects[kindTable] = map[string]*objectState{
+		"audit_log": {owner: "app_user", acl: aclSet{"auditor": {"INSERT": true}}},
+		"orders":    {owner: "app_user", acl: aclSet{"auditor": {"SELECT": true}}},
+	}
+	schema.objects[kindFunction] = map[string]*objectState{
+		"log_event(text, integer)": {owner: "app_user", args: "text, integer", acl: aclSet{}},
+	}
+	catalog.schemas["audit"] = schema
+
+	schemas := []Schema{{
+		Name: "audit",
+		Grants: []SchemaGrant{{
+			Role: "auditor",
+			Objects: []ObjectGrant{
+				{Type: "table", Name: "audit_log", Privileges: []string{"INSERT"}},
+				{Type: "function", Name: "log_event", Args: "text, integer", Privileges: []string{"EXECUTE"}},
+				{Type: "view", Name: "recent_events", Privileges: []string{"SELECT"}},
+			},
+		}},
+	}}
+
+	steps, err := planSchemas("app_db", schemas, catalog, Options{Strict: true})
+	require.NoError(t, err)
+	require.Len(t, steps, 4, "the grant on the missing view is skipped")
+	assert.Equal(t, ActionNoop, steps[1].Action)
+	assert.Equal(t, "GRANT INSERT ON TABLE audit.audit_log TO auditor", steps[1].SQL)
+	assert.Equal(t, ActionUpdate, steps[2].Action)
+	assert.Equal(t, "GRANT EXECUTE ON FUNCTION audit.log_event(text, integer) TO auditor", steps[2].SQL)
+	assert.Equal(t, "REVOKE SELECT ON TABLE audit.orders FROM auditor", steps[3].SQL)
+
+	_, err = planSchemas("app_db", []Schema{{
+		Name:   "audit",
+		Grants: []SchemaGrant{{Role: "auditor", Objects: []ObjectGrant{{Type: "index", Name: "x", Privileges: []string{"SELECT"}}}}},
+	}}, catalog, Options{})
+	assert.Error(t, err)
+}
+
+// TestPlanObjectGrantsResolvedFunction tests that functions are matched by
+// the signature the server resolved, however the config spells it
+func TestPlanObjectGrantsResolvedFunction(t *testing.T) {
+	catalog := newDatabaseCatalog()
+	schema := &schemaState{owner: "app_user", acl: aclSet{}, objects: map[objectKind]map[string]*objectState{}}
+	schema.objects[kindFunction] = map[string]*objectState{
+		"log_event(text, integer)": {owner: "app_user", args: "text, integer", acl: aclSet{"auditor": {"EXECUTE": true}}},
+	}
+	catalog.schemas["audit"] = schema
+	catalog.functions[functionKey{"audit", "log_event", "TEXT,int"}] = "log_event(text, integer)"
+
+	steps, err := planSchemas("app_db", []Schema{{
+		Name: "audit",
+		Grants: []SchemaGrant{{Role: "auditor", Objects: []ObjectGrant{
+			{Type: "function", Name: "log_event", Args: "TEXT,int", Privileges: []string{"EXECUTE"}},
+		}}},
+	}}, catalog, Options{Strict: true})
+	require.NoError(t, err)
+	require.Len(t, steps, 2, "the declared EXECUTE is not revoked")
+	assert.Equal(t, ActionNoop, steps[1].Action)
+	assert.Equal(t, "GRANT EXECUTE ON FUNCTION audit.log_event(text, integer) TO auditor", steps[1].SQL)
+}
+
+// TestPlanRowSecurity tests row-level security flags and policy drift
+func TestPlanRowSecurity(t *testing.T) {
+	catalog := newDatabaseCatalog()
+	schema := &schemaState{owner: "app_user", acl: aclSet{}, objects: map[objectKind]map[string]*objectState{}}
+	schema.objects[kindTable] = map[string]*objectState{
+		"orders": {owner: "app_user", acl: aclSet{}, rowSecurity: true, policies: map[string]*policyState{
+			"tenant_isolation": {command: "ALL", roles: []string{"app_role"},
+				using: "(tenant_id = (current_setting('app.tenant'::text))::integer)"},
+			"tenant_insert": {command: "INSERT", roles: []string{"PUBLIC"}, withCheck: "true"},
+			"readers":       {command: "ALL", roles: []string{"reporting"}, using: "true"},
+			"legacy":        {command: "SELECT", roles: []string{"PUBLIC"}, using: "true"},
+			"regions":       {command: "SELECT", roles: []string{"PUBLIC"}, using: "(((a = 1) OR (b = 2)) AND (c = 3))"},
+			"named":         {command: "SELECT", roles: []string{"PUBLIC"}, using: "(name = 'x'::text)"},
+			"active":        {command: "SELECT", roles: []string{"PUBLIC"}, using: "(active AND (NOT archived))"},
+		}},
+	}
+	catalog.schemas["app"] = schema
+	// Deparsed by the server in the apply transaction
+	catalog.expressions[expressionKey{"app", "orders", "tenant_id = current_setting('app.tenant')::integer"}] =
+		"(tenant_id = (current_setting('app.tenant'::text))::integer)"
+	catalog.expressions[expressionKey{"app", "orders", "a = 1 OR (b = 2 AND c = 3)"}] = "((a = 1) OR ((b = 2) AND (c = 3)))"
+
+	enable, force := true, true
+	schemas := []Schema{{
+		Name: "app",
+		RowSecurity: []TableRowSecurity{
+			{Table: "orders", Enable: &enable, Force: &force, Policies: []Policy{
+				{Name: "tenant_isolation", Roles: []string{"app_role"}, Using: "tenant_id = current_setting('app.tenant')::integer"},
+				{Name: "tenant_insert", Command: "insert", Restrictive: true, WithCheck: "true"},
+				{Name: "readers", Roles: []string{"reporting", "analytics"}, Using: "true"},
+				{Name: "archived", Command: "SELECT", Using: "archived"},
+				{Name: "regions", Command: "SELECT", Using: "a = 1 OR (b = 2 AND c = 3)"},
+				{Name: "named", Command: "SELECT", Using: "(name = 'x::text')"},
+				{Name: "active", Command: "SELECT", Using: "( Active\n  AND (NOT archived) )"},
+			}},
+			{Table: "invoices", Policies: []Policy{{Name: "p", Using: "true"}}},
+		},
+	}}
+
+	steps, err := planSchemas("app_db", schemas, catalog, Options{Strict: true})
+	require.NoError(t, err)
+	var got []string
+	for _, step := range steps[1:] {
+		got = append(got, string(step.Action)+" "+step.SQL)
+	}
+	assert.Equal(t, []string{
+		"no-op ALTER TABLE app.orders ENABLE ROW LEVEL SECURITY",
+		"update ALTER TABLE app.orders FORCE ROW LEVEL SECURITY",
+		"no-op ALTER POLICY tenant_isolation ON app.orders TO app_role USING (tenant_id = current_setting('app.tenant')::integer)",
+		"drop DROP POLICY IF EXISTS tenant_insert ON app.orders",
+		"create CREATE POLICY tenant_insert ON app.orders AS RESTRICTIVE FOR INSERT TO PUBLIC WITH CHECK (true)",
+		"update ALTER POLICY readers ON app.orders TO analytics, reporting USING (true)",
+		"create CREATE POLICY archived ON app.orders AS PERMISSIVE FOR SELECT TO PUBLIC USING (archived)",
+		"update ALTER POLICY regions ON app.orders TO PUBLIC USING (a = 1 OR (b = 2 AND c = 3))",
+		"update ALTER POLICY named ON app.orders TO PUBLIC USING ((name = 'x::text'))",
+		"no-op ALTER POLICY active ON app.orders TO PUBLIC USING (( Active\n  AND (NOT archived) ))",
+		"drop DROP POLICY IF EXISTS legacy ON app.orders",
+	}, got, "the policies on the missing invoices table are skipped")
+
+	_, err = planSchemas("app_db", []Schema{{
+		Name: "app",
+		RowSecurity: []TableRowSecurity{{Table: "orders", Policies: []Policy{
+			{Name: "bad", Command: "SELECT", WithCheck: "true"},
+		}}},
+	}}, catalog, Options{})
+	assert.Error(t, err)
+}
+
+// TestNormalizeExpression tests that only the layout of an expression is
+// folded
+func TestNormalizeExpression(t *testing.T) {
+	assert.Equal(t, "(a = 1 or b = 2) and c = 3", normalizeExpression("( a = 1\n OR b = 2 )  AND c = 3"))
+	assert.NotEqual(t, normalizeExpression("(a = 1 OR b = 2) AND c = 3"), normalizeExpression("a = 1 OR (b = 2 AND c = 3)"))
+	assert.NotEqual(t, normalizeExpression("name = 'x::text'"), normalizeExpression("name = 'x'"))
+	assert.Equal(t, "name = 'A  B'", normalizeExpression("NAME   = 'A  B'"))
+}
+
+// TestPlanExtensions tests extension entries given as names or mappings,
+// version updates and the availability check
+func TestPlanExtensions(t *testing.T) {
+	var db Database
+	require.NoError(t, yaml.Unmarshal([]byte(`
+name: app
+extensions:
+  - uuid-ossp
+  - name: postgis
+    version: "3.4.2"
+    cascade: true
+  - name: pgcrypto
+    schema: extensions
+`), &db))
+	require.Equal(t, []Extension{
+		{Name: "uuid-ossp"},
+		{Name: "postgis", Version: "3.4.2", Cascade: true},
+		{Name: "pgcrypto", Schema: "extensions"},
+	}, db.Extensions)
+
+	catalog := newDatabaseCatalog()
+	catalog.extensions["uuid-ossp"] = &extensionState{version: "1.1", schema: "public"}
+	catalog.extensions["postgis"] = &extensionState{version: "3.4.0", schema: "public"}
+
+	steps := planExtensions("app", db.Extensions, catalog)
+	require.Len(t, steps, 3)
+	assert.Equal(t, ActionNoop, steps[0].Action)
+	assert.Equal(t, ActionUpdate, steps[1].Action)
+	assert.Equal(t, `ALTER EXTENSION postgis UPDATE TO '3.4.2'`, steps[1].SQL)
+	assert.Equal(t, ActionCreate, steps[2].Action)
+	assert.Equal(t, `CREATE EXTENSION IF NOT EXISTS pgcrypto SCHEMA extensions`, steps[2].SQL)
+
+	catalog.extensions["pgcrypto"] = &extensionState{version: "1.3", schema: "public"}
+	assert.Equal(t, []string{"extension pgcrypto in database app is installed in schema public, not extensions"},
+		extensionDrift("app", db.Extensions, catalog))
+
+	available := map[string]map[string]bool{
+		"uuid-ossp": {"1.1": true},
+		"postgis":   {"3.4.0": true, "3.4.2": true},
+		"pgcrypto":  {"1.3": true},
+	}
+	assert.NoError(t, checkExtensions([]Database{db}, available))
+
+	db.Schemas = []Schema{{Name: "extensions"}}
+	steps, err := planDatabaseSteps(db, newDatabaseCatalog(), managedSet{}, Options{})
+	require.NoError(t, err)
+	require.Len(t, steps, 4)
+	assert.Equal(t, `CREATE SCHEMA IF NOT EXISTS extensions`, steps[2].SQL)
+	assert.Equal(t, `CREATE EXTENSION IF NOT EXISTS pgcrypto SCHEMA extensions`, steps[3].SQL, "extensions follow the schema they are installed in")
+
+	delete(available, "pgcrypto")
+	delete(available["postgis"], "3.4.2")
+	err = checkExtensions([]Database{db}, available)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "version 3.4.2 of extension postgis for database app is not available on the server; available versions: 3.4.0")
+	assert.Contains(t, err.Error(), "extension pgcrypto for database app is not available on the server")
+}
+
+// TestPlanSettings tests database, role and per-database role settings
+func TestPlanSettings(t *testing.T) {
+	state := newClusterState()
+	state.settings[settingKey{role: "app_user"}] = map[string]string{"statement_timeout": "30s", "work_mem": "64MB"}
+	state.settings[settingKey{role: "app_readonly"}] = map[string]string{"default_transaction_read_only": "on"}
+	state.settings[settingKey{database: "app"}] = parseSettings([]string{"TimeZone=UTC"})
+	state.settings[settingKey{role: "reporting", database: "app"}] = map[string]string{"statement_timeout": "0"}
+
+	config := &Config{
+		Roles: []Role{{Name: "app_readonly", Settings: map[string]string{"default_transaction_read_only": "on"}}},
+		Users: []User{{Name: "app_user", Settings: map[string]string{"statement_timeout": "30s"}}},
+		Databases: []Database{{
+			Name:     "app",
+			Settings: map[string]string{"TimeZone": "UTC"},
+			RoleSettings: map[string]map[string]string{
+				"app_user": {"search_path": "app, public"},
+			},
+		}},
+	}
+
+	var got []string
+	for _, step := range planSettings(config, state, Options{Strict: true}) {
+		got = append(got, string(step.Action)+" "+step.SQL)
+	}
+	assert.Equal(t, []string{
+		"no-op ALTER ROLE app_readonly SET default_transaction_read_only = 'on'",
+		"no-op ALTER ROLE app_user SET statement_timeout = '30s'",
+		"update ALTER ROLE app_user RESET work_mem",
+		"no-op ALTER DATABASE app SET timezone = 'UTC'",
+		"update ALTER ROLE app_user IN DATABASE app SET search_path = 'app', 'public'",
+		"update ALTER ROLE reporting IN DATABASE app RESET statement_timeout",
+	}, got)
+
+	steps := planSettings(config, state, Options{})
+	assert.Len(t, steps, 4, "settings the config doesn't declare are only reset in strict mode")
+}
+
+// TestPlanDatabaseProperties tests that mutable properties of existing
+// databases are altered
+func TestPlanDatabaseProperties(t *testing.T) {
+	state := newClusterState()
+	state.databases["app"] = &databaseState{owner: "app_user", connLimit: -1, tablespace: "pg_default", allowConn: true, acl: aclSet{}}
+
+	limit, allow, template := 20, true, true
+	steps, err := planDatabases([]Database{{
+		Name:             "app",
+		ConnectionLimit:  &limit,
+		AllowConnections: &allow,
+		IsTemplate:       &template,
+		Tablespace:       "fast_ssd",
+	}}, state, Options{})
+	require.NoError(t, err)
+
+	var got []string
+	for _, step := range steps {
+		got = append(got, string(step.Action)+" "+step.SQL)
+	}
+	assert.Equal(t, []string{
+		"no-op CREATE DATABASE app TABLESPACE fast_ssd ALLOW_CONNECTIONS true CONNECTION LIMIT 20 IS_TEMPLATE true",
+		"update ALTER DATABASE app WITH CONNECTION LIMIT 20",
+		"no-op ALTER DATABASE app WITH ALLOW_CONNECTIONS true",
+		"update ALTER DATABASE app WITH IS_TEMPLATE true",
+		"update ALTER DATABASE app SET TABLESPACE fast_ssd",
+	}, got)
+}
+
+// TestPlanTablespaces tests tablespace creation and that the owner, options
+// and grants of existing tablespaces are reconciled
+func TestPlanTablespaces(t *testing.T) {
+	state := newClusterState()
+	state.tablespaces["fast_ssd"] = &tablespaceState{owner: "postgres", location: "/mnt/ssd", acl: aclSet{},
+		options: map[string]string{"random_page_cost": "1.1", "effective_io_concurrency": "200"}}
+	state.tablespaces["fast_ssd"].acl.declare("postgres", []string{"CREATE"})
+	state.tablespaces["fast_ssd"].acl.declare("app_user", []string{"CREATE"})
+	state.tablespaces["fast_ssd"].acl.declare("reader", []string{"CREATE"})
+
+	tablespaces := []Tablespace{
+		{
+			Name:     "fast_ssd",
+			Location: "/mnt/ssd",
+			Owner:    "app_user",
+			Options:  map[string]string{"random_page_cost": "1.1", "Seq_Page_Cost": "1.0"},
+			Grants:   []TablespaceGrant{{User: "app_user", Privileges: []string{"create"}}},
+		},
+		{
+			Name:     "archive",
+			Location: "/mnt/archive",
+			Options:  map[string]string{"seq_page_cost": "4"},
+			Grants:   []TablespaceGrant{{User: "reader", Privileges: []string{"ALL"}}},
+		},
+	}
+
+	steps, err := planTablespaces(tablespaces, state, Options{Strict: true})
+	require.NoError(t, err)
+	var got []string
+	for _, step := range steps {
+		got = append(got, string(step.Action)+" "+step.SQL)
+	}
+	assert.Equal(t, []string{
+		"no-op CREATE TABLESPACE fast_ssd OWNER app_user LOCATION '/mnt/ssd' WITH (seq_page_cost = '1.0', random_page_cost = '1.1')",
+		"update ALTER TABLESPACE fast_ssd OWNER TO app_user",
+		"update ALTER TABLESPACE fast_ssd SET (seq_page_cost = '1.0')",
+		"no-op ALTER TABLESPACE fast_ssd SET (random_page_cost = '1.1')",
+		"update ALTER TABLESPACE fast_ssd RESET (effective_io_concurrency)",
+		"no-op GRANT CREATE ON TABLESPACE fast_ssd TO app_user",
+		"update REVOKE CREATE ON TABLESPACE fast_ssd FROM reader",
+		"create CREATE TABLESPACE archive LOCATION '/mnt/archive' WITH (seq_page_cost = '4')",
+		"update GRANT ALL ON TABLESPACE archive TO reader",
+	}, got)
+
+	steps, err = planTablespaces(tablespaces, state, Options{})
+	require.NoError(t, err)
+	assert.Len(t, steps, 7, "options and privileges are only removed in strict mode")
+}
+
+// TestPlanReassignObjects tests that existing schemas and their objects are
+// given to the declared owner
+func TestPlanReassignObjects(t *testing.T) {
+	catalog := newDatabaseCatalog()
+	schema := &schemaState{owner: "postgres", acl: aclSet{}, objects: map[objectKind]map[string]*objectState{}}
+	schema.acl.declare("postgres", []string{"USAGE", "CREATE"})
+	schema.objects[kindTable] = map[string]*objectState{
+		"orders":        {owner: "migrator", relkind: "r", acl: aclSet{"migrator": {"SELECT": true}, "app_owner": {"SELECT": true}}},
+		"order_summary": {owner: "migrator", relkind: "m", acl: aclSet{}},
+		"customers":     {owner: "app_owner", relkind: "r", acl: aclSet{}},
+	}
+	schema.objects[kindSequence] = map[string]*objectState{
+		"orders_id_seq": {owner: "migrator", relkind: "S", linked: true, acl: aclSet{}},
+		"invoice_no":    {owner: "migrator", relkind: "S", acl: aclSet{}},
+	}
+	schema.objects[kindFunction] = map[string]*objectState{
+		"total(integer)":     {owner: "migrator", args: "integer", acl: aclSet{}},
+		"digest(text, text)": {owner: "postgres", args: "text, text", extension: true, acl: aclSet{"PUBLIC": {"EXECUTE": true}}},
+	}
+	catalog.schemas["app"] = schema
+
+	steps, err := planSchemas("app_db", []Schema{{Name: "app", Owner: "app_owner", ReassignObjects: true}}, catalog, Options{Strict: true})
+	require.NoError(t, err)
+	var got []string
+	for _, step := range steps[1:] {
+		got = append(got, string(step.Action)+" "+step.SQL)
+	}
+	assert.Equal(t, []string{
+		"update ALTER SCHEMA app OWNER TO app_owner",
+		"update ALTER MATERIALIZED VIEW app.order_summary OWNER TO app_owner",
+		"update ALTER TABLE app.orders OWNER TO app_owner",
+		"update ALTER SEQUENCE app.invoice_no OWNER TO app_owner",
+		"update ALTER ROUTINE app.total(integer) OWNER TO app_owner",
+	}, got, "the linked sequence follows its table, extension members are left alone, "+
+		"and neither owner loses privileges in strict mode")
+
+	// Naming an extension member in an object grant puts its privileges
+	// under strict mode
+	steps, err = planSchemas("app_db", []Schema{{Name: "app", Owner: "postgres", Grants: []SchemaGrant{{
+		Role:    "app_owner",
+		Objects: []ObjectGrant{{Type: "function", Name: "digest", Args: "text, text", Privileges: []string{"EXECUTE"}}},
+	}}}}, catalog, Options{Strict: true})
+	require.NoError(t, err)
+	assert.Contains(t, steps, Step{Action: ActionUpdate, Database: "app_db", SQL: "REVOKE EXECUTE ON FUNCTION app.digest(text, text) FROM PUBLIC"})
+}
@@ -0,0 +1,259 @@
+package dbstrap
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Pruning drops objects dbstrap managed in an earlier run that are no longer
+// in the config. Which objects are managed is recorded in a table in the
+// DATABASE_URL database; it is only created and maintained when pruning is
+// enabled, so objects are only ever dropped after a pruning run has seen them
+// in the config.
+
+const (
+	managedRole      = "role"
+	managedDatabase  = "database"
+	managedSchema    = "schema"
+	managedExtension = "extension"
+)
+
+// managedKey identifies an object dbstrap manages. database is set for
+// schemas and extensions only.
+type managedKey struct {
+	kind     string
+	database string
+	name     string
+}
+
+type managedSet map[managedKey]bool
+
+// sorted returns the keys of kind in a stable order
+func (m managedSet) sorted(kind string) []managedKey {
+	var keys []managedKey
+	for key := range m {
+		if key.kind == kind {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].database != keys[j].database {
+			return keys[i].database < keys[j].database
+		}
+		return keys[i].name < keys[j].name
+	})
+	return keys
+}
+
+// schemaNames returns the schemas of db recorded as managed
+func (m managedSet) schemaNames(db string) []string {
+	var names []string
+	for _, key := range m.sorted(managedSchema) {
+		if key.database == db {
+			names = append(names, key.name)
+		}
+	}
+	return names
+}
+
+// configManaged returns the objects config declares
+func configManaged(config *Config) managedSet {
+	managed := managedSet{}
+	for _, role := range config.Roles {
+		managed[managedKey{kind: managedRole, name: role.Name}] = true
+	}
+	for _, user := range config.Users {
+		managed[managedKey{kind: managedRole, name: user.Name}] = true
+	}
+	for _, db := range config.Databases {
+		managed[managedKey{kind: managedDatabase, name: db.Name}] = true
+		for _, extension := range db.Extensions {
+			managed[managedKey{kind: managedExtension, database: db.Name, name: extension.Name}] = true
+		}
+		for _, schema := range db.Schemas {
+			managed[managedKey{kind: managedSchema, database: db.Name, name: schema.Name}] = true
+		}
+	}
+	return managed
+}
+
+// inspectManaged reads the objects recorded by earlier pruning runs
+func inspectManaged(ctx context.Context, q querier) (managedSet, error) {
+	managed := managedSet{}
+
+	var exists bool
+	rows, err := q.Query(ctx, "SELECT to_regclass('dbstrap.managed_objects') IS NOT NULL")
+	if err != nil {
+		return nil, fmt.Errorf("failed to check for managed objects table: %w", err)
+	}
+	for rows.Next() {
+		if err := rows.Scan(&exists); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to check for managed objects table: %w", err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to check for managed objects table: %w", err)
+	}
+	if !exists {
+		return managed, nil
+	}
+
+	rows, err = q.Query(ctx, "SELECT kind, database, name FROM dbstrap.managed_objects")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read managed objects: %w", err)
+	}
+	for rows.Next() {
+		var key managedKey
+		if err := rows.Scan(&key.kind, &key.database, &key.name); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to read managed objects: %w", err)
+		}
+		managed[key] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read managed objects: %w", err)
+	}
+	return managed, nil
+}
+
+// recordManaged replaces the recorded objects with managed
+func recordManaged(ctx context.Context, conn *pgx.Conn, managed managedSet) error {
+	slog.Info("Recording managed objects", "count", len(managed))
+	return pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+		for _, sql := range []string{
+			"CREATE SCHEMA IF NOT EXISTS dbstrap",
+			`CREATE TABLE IF NOT EXISTS dbstrap.managed_objects (
+				kind text NOT NULL,
+				database text NOT NULL DEFAULT '',
+				name text NOT NULL,
+				PRIMARY KEY (kind, database, name)
+			)`,
+			"DELETE FROM dbstrap.managed_objects",
+		} {
+			if _, err := tx.Exec(ctx, sql); err != nil {
+				return fmt.Errorf("failed to record managed objects: %w", err)
+			}
+		}
+		for key := range managed {
+			if _, err := tx.Exec(ctx, "INSERT INTO dbstrap.managed_objects (kind, database, name) VALUES ($1, $2, $3)",
+				key.kind, key.database, key.name); err != nil {
+				return fmt.Errorf("failed to record managed objects: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+// planPruneDatabases plans DROP DATABASE for managed databases that are no
+// longer configured. Without opts.PruneDatabases they are only reported. It
+// returns the steps and the databases they drop.
+func planPruneDatabases(config *Config, managed managedSet, state *clusterState, opts Options) ([]Step, map[string]bool) {
+	declared := configManaged(config)
+	dropped := map[string]bool{}
+
+	var steps []Step
+	for _, key := range managed.sorted(managedDatabase) {
+		if declared[key] {
+			continue
+		}
+		if _, exists := state.databases[key.name]; !exists {
+			continue
+		}
+		if !opts.PruneDatabases {
+			slog.Warn("Not dropping database removed from config without confirmation", "database", key.name)
+			continue
+		}
+		dropped[key.name] = true
+		steps = append(steps, Step{Action: ActionDrop, SQL: dropDatabaseSQL(key.name)})
+	}
+	return steps, dropped
+}
+
+// planPruneRoles plans dropping managed roles that are no longer configured.
+// Objects they own are reassigned and their privileges dropped in every
+// database that accepts connections before the role itself is dropped.
+func planPruneRoles(config *Config, managed managedSet, state *clusterState, dropped map[string]bool, opts Options) []Step {
+	declared := configManaged(config)
+
+	var databases []string
+	for _, name := range sortedKeys(state.databases) {
+		if state.databases[name].allowConn && !dropped[name] {
+			databases = append(databases, name)
+		}
+	}
+
+	var steps []Step
+	for _, key := range managed.sorted(managedRole) {
+		if declared[key] {
+			continue
+		}
+		if _, exists := state.roles[key.name]; !exists {
+			continue
+		}
+		for _, db := range databases {
+			steps = append(steps,
+				Step{Action: ActionDrop, Database: db, SQL: reassignOwnedSQL(key.name, opts.ReassignTo)},
+				Step{Action: ActionDrop, Database: db, SQL: dropOwnedSQL(key.name)},
+			)
+		}
+		steps = append(steps, Step{Action: ActionDrop, SQL: dropRoleSQL(key.name)})
+	}
+	return steps
+}
+
+// planPruneDatabaseObjects plans dropping managed extensions and schemas of db
+// that are no longer configured. Extensions go first, since one installed in
+// a pruned schema would keep it from being dropped. Schemas are dropped
+// without CASCADE, so a schema that still contains objects stops the run
+// instead of losing data.
+func planPruneDatabaseObjects(db Database, managed managedSet, catalog *databaseCatalog) []Step {
+	declared := configManaged(&Config{Databases: []Database{db}})
+
+	var steps []Step
+	for _, key := range managed.sorted(managedExtension) {
+		if key.database != db.Name || declared[key] {
+			continue
+		}
+		if catalog.extensions[key.name] != nil {
+			steps = append(steps, Step{Action: ActionDrop, Database: db.Name, SQL: dropExtensionSQL(key.name)})
+		}
+	}
+	for _, key := range managed.sorted(managedSchema) {
+		if key.database != db.Name || declared[key] {
+			continue
+		}
+		if _, exists := catalog.schemas[key.name]; exists {
+			steps = append(steps, Step{Action: ActionDrop, Database: db.Name, SQL: dropSchemaSQL(key.name)})
+		}
+	}
+	return steps
+}
+
+// remainingManaged returns what to record after a successful pruning run:
+// everything config declares, plus databases that were kept for lack of
+// confirmation along with their schemas and extensions
+func remainingManaged(config *Config, managed managedSet, dropped map[string]bool) managedSet {
+	remaining := configManaged(config)
+	configured := map[string]bool{}
+	for _, db := range config.Databases {
+		configured[db.Name] = true
+	}
+	for key := range managed {
+		switch key.kind {
+		case managedDatabase:
+			if !configured[key.name] && !dropped[key.name] {
+				remaining[key] = true
+			}
+		case managedSchema, managedExtension:
+			if !configured[key.database] && !dropped[key.database] {
+				remaining[key] = true
+			}
+		}
+	}
+	return remaining
+}
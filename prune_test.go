@@ -0,0 +1,74 @@
+package dbstrap
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestPlanPrune tests that managed objects removed from the config are
+// dropped and that databases need confirmation
+func TestPlanPrune(t *testing.T) {
+	config := &Config{
+		Users: []User{{Name: "app_user", CanLogin: true}},
+		Databases: []Database{{
+			Name:       "app",
+			Owner:      "app_user",
+			Extensions: []Extension{{Name: "pgcrypto"}},
+			Schemas:    []Schema{{Name: "app"}},
+		}},
+	}
+	managed := configManaged(config)
+	managed[managedKey{kind: managedRole, name: "old_user"}] = true
+	managed[managedKey{kind: managedDatabase, name: "old_db"}] = true
+	managed[managedKey{kind: managedSchema, database: "old_db", name: "legacy"}] = true
+	managed[managedKey{kind: managedSchema, database: "app", name: "legacy"}] = true
+	managed[managedKey{kind: managedExtension, database: "app", name: "uuid-ossp"}] = true
+	managed[managedKey{kind: managedExtension, database: "app", name: "hstore"}] = true
+
+	state := newClusterState()
+	state.roles["app_user"] = &roleState{canLogin: true}
+	state.roles["old_user"] = &roleState{canLogin: true}
+	state.databases["app"] = &databaseState{owner: "app_user", allowConn: true, acl: aclSet{}}
+	state.databases["old_db"] = &databaseState{owner: "old_user", allowConn: true, acl: aclSet{}}
+	state.databases["template0"] = &databaseState{owner: "postgres", acl: aclSet{}}
+
+	steps, dropped := planPruneDatabases(config, managed, state, Options{Prune: true})
+	assert.Empty(t, steps, "databases are only dropped with confirmation")
+	assert.Empty(t, dropped)
+
+	opts := Options{Prune: true, PruneDatabases: true, ReassignTo: "admin"}
+	steps, dropped = planPruneDatabases(config, managed, state, opts)
+	require.Len(t, steps, 1)
+	assert.Equal(t, Step{Action: ActionDrop, SQL: "DROP DATABASE IF EXISTS old_db"}, steps[0])
+
+	steps = planPruneRoles(config, managed, state, dropped, opts)
+	assert.Equal(t, []Step{
+		{Action: ActionDrop, Database: "app", SQL: "REASSIGN OWNED BY old_user TO admin"},
+		{Action: ActionDrop, Database: "app", SQL: "DROP OWNED BY old_user"},
+		{Action: ActionDrop, SQL: "DROP ROLE IF EXISTS old_user"},
+	}, steps)
+
+	catalog := newDatabaseCatalog()
+	catalog.extensions["pgcrypto"] = &extensionState{version: "1.3", schema: "public"}
+	catalog.extensions["uuid-ossp"] = &extensionState{version: "1.1", schema: "legacy"}
+	catalog.schemas["app"] = &schemaState{acl: aclSet{}}
+	catalog.schemas["legacy"] = &schemaState{acl: aclSet{}}
+
+	// uuid-ossp lives in legacy, so it has to go before the schema can
+	steps = planPruneDatabaseObjects(config.Databases[0], managed, catalog)
+	assert.Equal(t, []Step{
+		{Action: ActionDrop, Database: "app", SQL: `DROP EXTENSION IF EXISTS "uuid-ossp"`},
+		{Action: ActionDrop, Database: "app", SQL: "DROP SCHEMA IF EXISTS legacy"},
+	}, steps)
+
+	remaining := remainingManaged(config, managed, map[string]bool{})
+	assert.True(t, remaining[managedKey{kind: managedDatabase, name: "old_db"}], "kept databases stay managed")
+	assert.True(t, remaining[managedKey{kind: managedSchema, database: "old_db", name: "legacy"}])
+	assert.False(t, remaining[managedKey{kind: managedRole, name: "old_user"}])
+	assert.False(t, remaining[managedKey{kind: managedSchema, database: "app", name: "legacy"}])
+
+	remaining = remainingManaged(config, managed, dropped)
+	assert.Equal(t, configManaged(config), remaining)
+}
@@ -0,0 +1,273 @@
+package dbstrap
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// renderSQL writes a psql script that applies config without a Go binary.
+// Roles and databases are created only when missing, so the script can be run
+// repeatedly. With passwordVars, passwords are read from psql variables named
+// after each user's password_env instead of being written into the script.
+// Other password sources have no variable to name, so they are refused rather
+// than written out.
+func renderSQL(w io.Writer, config *Config, passwordVars bool) error {
+	var b strings.Builder
+
+	b.WriteString("-- Generated by dbstrap\n")
+	if passwordVars {
+		var vars []string
+		for _, user := range config.Users {
+			if !user.CanLogin {
+				continue
+			}
+			if user.PasswordEnv != "" {
+				vars = append(vars, "-v "+user.PasswordEnv+"=...")
+			} else if user.PasswordFile != "" || len(user.PasswordCommand) > 0 || user.PasswordVault != "" {
+				return fmt.Errorf("user %s: only passwords from password_env can be left as psql variables; "+
+					"unset BOOTSTRAP_PASSWORD_VARS to write the others into the script", user.Name)
+			}
+		}
+		if len(vars) > 0 {
+			fmt.Fprintf(&b, "-- Run with: psql %s -f <this file>\n", strings.Join(vars, " "))
+		}
+	}
+	b.WriteString("\\set ON_ERROR_STOP on\n")
+
+	for _, role := range config.Roles {
+		fmt.Fprintf(&b, "\n-- Role %s\n", role.Name)
+		renderCreateRole(&b, User{Name: role.Name, RoleAttributes: role.RoleAttributes}, false)
+		if opts := role.options(nil); len(opts) > 0 {
+			b.WriteString(alterRoleSQL(role.Name, opts) + ";\n")
+		}
+	}
+	for i, role := range config.Roles {
+		if i == 0 {
+			b.WriteString("\n-- Role memberships\n")
+		}
+		for _, member := range role.Roles {
+			b.WriteString(grantRoleSQL(member, role.Name) + ";\n")
+		}
+	}
+
+	for _, user := range config.Users {
+		fmt.Fprintf(&b, "\n-- User %s\n", user.Name)
+		renderCreateRole(&b, user, passwordVars)
+		if opts := user.options(nil); len(opts) > 0 {
+			b.WriteString(alterRoleSQL(user.Name, opts) + ";\n")
+		}
+		if user.syncPassword() && user.CanLogin {
+			if passwordVars && user.PasswordEnv != "" {
+				fmt.Fprintf(&b, "SELECT %s || quote_literal(:'%s')\\gexec\n",
+					quoteLiteral(fmt.Sprintf("ALTER ROLE %s WITH PASSWORD ", quoteIdent(user.Name))), user.PasswordEnv)
+			} else if user.Password != "" {
+				b.WriteString(alterRolePasswordSQL(user.Name, user.Password) + ";\n")
+			}
+		}
+		for _, role := range user.Roles {
+			b.WriteString(grantRoleSQL(role, user.Name) + ";\n")
+		}
+	}
+
+	for _, tablespace := range config.Tablespaces {
+		fmt.Fprintf(&b, "\n-- Tablespace %s\n", tablespace.Name)
+		// CREATE TABLESPACE cannot run inside a DO block either
+		fmt.Fprintf(&b, "SELECT %s\nWHERE NOT EXISTS (SELECT 1 FROM pg_tablespace WHERE spcname = %s)\\gexec\n",
+			quoteLiteral(createTablespaceSQL(tablespace)), quoteLiteral(tablespace.Name))
+		for _, grant := range tablespace.Grants {
+			grantCmd, err := grantTablespaceSQL(grant.Privileges, tablespace.Name, grant.User)
+			if err != nil {
+				return err
+			}
+			b.WriteString(grantCmd + ";\n")
+		}
+	}
+
+	for _, db := range config.Databases {
+		fmt.Fprintf(&b, "\n-- Database %s\n", db.Name)
+		// CREATE DATABASE cannot run inside a DO block, so guard it with \gexec
+		fmt.Fprintf(&b, "SELECT %s\nWHERE NOT EXISTS (SELECT 1 FROM pg_database WHERE datname = %s)\\gexec\n",
+			quoteLiteral(createDatabaseSQL(db)), quoteLiteral(db.Name))
+		if db.Owner != "" {
+			b.WriteString(alterDatabaseOwnerSQL(db.Name, db.Owner) + ";\n")
+		}
+		for _, grant := range db.Grants {
+			grantCmd, err := grantDatabaseSQL(grant.Privileges, db.Name, grant.User)
+			if err != nil {
+				return err
+			}
+			b.WriteString(grantCmd + ";\n")
+		}
+	}
+
+	if settings := planSettings(config, newClusterState(), Options{}); len(settings) > 0 {
+		b.WriteString("\n-- Settings\n")
+		for _, step := range settings {
+			b.WriteString(step.SQL + ";\n")
+		}
+	}
+
+	for _, db := range config.Databases {
+		// Plan against an empty catalog so every statement is rendered; they
+		// are all idempotent. The empty catalog has no tables or functions, so
+		// what applies to individual ones is rendered with guards instead.
+		steps, err := planDatabaseSteps(withoutObjectGrants(db), newDatabaseCatalog(), managedSet{}, Options{})
+		if err != nil {
+			return err
+		}
+		var guarded strings.Builder
+		if err := renderObjectGrants(&guarded, db); err != nil {
+			return err
+		}
+		if len(steps) == 0 && guarded.Len() == 0 {
+			continue
+		}
+
+		// The plan only transfers existing schemas, and an empty catalog has
+		// none, so ownership follows every CREATE SCHEMA; both are idempotent
+		owners := map[string]string{}
+		for _, schema := range db.Schemas {
+			if schema.Owner != "" {
+				owners[createSchemaSQL(schema)] = alterSchemaOwnerSQL(schema.Name, schema.Owner)
+			}
+		}
+
+		fmt.Fprintf(&b, "\n\\connect %s\n", quoteIdent(db.Name))
+		for _, step := range steps {
+			b.WriteString(step.SQL + ";\n")
+			if owner, ok := owners[step.SQL]; ok {
+				b.WriteString(owner + ";\n")
+			}
+		}
+		b.WriteString(guarded.String())
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// renderCreateRole writes a CREATE ROLE guarded against existing roles
+func renderCreateRole(b *strings.Builder, user User, passwordVars bool) {
+	exists := fmt.Sprintf("SELECT 1 FROM pg_roles WHERE rolname = %s", quoteLiteral(user.Name))
+
+	// psql does not interpolate variables inside DO blocks, so the statement
+	// is built as a string and run with \gexec instead
+	if passwordVars && user.CanLogin && user.PasswordEnv != "" {
+		fmt.Fprintf(b, "SELECT %s || quote_literal(:'%s')\nWHERE NOT EXISTS (%s)\\gexec\n",
+			quoteLiteral(createRoleSQL(user.Name, user.CanLogin, user.RoleAttributes, "")+" PASSWORD "), user.PasswordEnv, exists)
+		return
+	}
+
+	fmt.Fprintf(b, "DO $dbstrap$\nBEGIN\n\tIF NOT EXISTS (%s) THEN\n\t\t%s;\n\tEND IF;\nEND\n$dbstrap$;\n",
+		exists, createRoleSQL(user.Name, user.CanLogin, user.RoleAttributes, user.Password))
+}
+
+// withoutObjectGrants returns a copy of db without the grants on individual
+// objects, column grants and row security, which renderObjectGrants writes
+func withoutObjectGrants(db Database) Database {
+	schemas := make([]Schema, len(db.Schemas))
+	for i, schema := range db.Schemas {
+		grants := make([]SchemaGrant, len(schema.Grants))
+		for j, grant := range schema.Grants {
+			grant.Objects = nil
+			grants[j] = grant
+		}
+		schema.Grants = grants
+		schema.ColumnGrants = nil
+		schema.RowSecurity = nil
+		schemas[i] = schema
+	}
+	db.Schemas = schemas
+	return db
+}
+
+// renderObjectGrants writes the grants on individual objects, the column
+// grants and the row security of db. Each is guarded with to_regclass or
+// to_regprocedure, so the script skips tables and functions that don't exist
+// yet instead of failing. Existing policies are altered, not recreated.
+func renderObjectGrants(b *strings.Builder, db Database) error {
+	for _, schema := range db.Schemas {
+		for _, grant := range schema.Grants {
+			grantee, err := schemaGrantee(grant)
+			if err != nil {
+				return err
+			}
+			for _, object := range grant.Objects {
+				kind, err := object.kind()
+				if err != nil {
+					return err
+				}
+				grantCmd, err := grantObjectSQL(object.Privileges, kind, schema.Name, object.Name, object.Args, grantee)
+				if err != nil {
+					return err
+				}
+				name := quoteIdent(schema.Name) + "." + quoteIdent(object.Name)
+				if kind != kindFunction {
+					renderBlock(b, fmt.Sprintf("to_regclass(%s) IS NOT NULL", quoteLiteral(name)), []string{grantCmd + ";"})
+					continue
+				}
+				// The function is named by the signature the server resolves,
+				// as when planning against a catalog
+				function := fmt.Sprintf("to_regprocedure(%s)", quoteLiteral(name+"("+object.Args+")"))
+				list, _ := privilegeList(kind, object.Privileges)
+				renderBlock(b, function+" IS NOT NULL", []string{fmt.Sprintf("EXECUTE %s || %s || %s;",
+					quoteLiteral("GRANT "+list+" ON FUNCTION "), function, quoteLiteral(" TO "+quoteGrantee(grantee)))})
+			}
+		}
+
+		for _, grant := range schema.ColumnGrants {
+			grantee, err := grant.grantee()
+			if err != nil {
+				return err
+			}
+			grantCmd, err := grantColumnsSQL(grant.Privileges, schema.Name, grant.Table, grant.Columns, grantee)
+			if err != nil {
+				return err
+			}
+			renderBlock(b, tableExists(schema.Name, grant.Table), []string{grantCmd + ";"})
+		}
+
+		for _, rls := range schema.RowSecurity {
+			var statements []string
+			if rls.Enable != nil {
+				statements = append(statements, rowSecuritySQL(schema.Name, rls.Table, *rls.Enable)+";")
+			}
+			if rls.Force != nil {
+				statements = append(statements, forceRowSecuritySQL(schema.Name, rls.Table, *rls.Force)+";")
+			}
+			for _, policy := range rls.Policies {
+				if err := policy.validate(); err != nil {
+					return fmt.Errorf("table %s.%s: %w", schema.Name, rls.Table, err)
+				}
+				statements = append(statements,
+					fmt.Sprintf("IF NOT EXISTS (SELECT 1 FROM pg_policies WHERE schemaname = %s AND tablename = %s AND policyname = %s) THEN",
+						quoteLiteral(schema.Name), quoteLiteral(rls.Table), quoteLiteral(policy.Name)),
+					"\t"+createPolicySQL(schema.Name, rls.Table, policy)+";",
+					"ELSE",
+					"\t"+alterPolicySQL(schema.Name, rls.Table, policy)+";",
+					"END IF;",
+				)
+			}
+			if len(statements) > 0 {
+				renderBlock(b, tableExists(schema.Name, rls.Table), statements)
+			}
+		}
+	}
+	return nil
+}
+
+// tableExists is a guard that holds when schema.table exists
+func tableExists(schema, table string) string {
+	return fmt.Sprintf("to_regclass(%s) IS NOT NULL", quoteLiteral(quoteIdent(schema)+"."+quoteIdent(table)))
+}
+
+// renderBlock writes a DO block that runs the lines of PL/pgSQL only when
+// condition holds
+func renderBlock(b *strings.Builder, condition string, lines []string) {
+	fmt.Fprintf(b, "DO $dbstrap$\nBEGIN\n\tIF %s THEN\n", condition)
+	for _, line := range lines {
+		fmt.Fprintf(b, "\t\t%s\n", line)
+	}
+	b.WriteString("\tEND IF;\nEND\n$dbstrap$;\n")
+}
@@ -0,0 +1,161 @@
+package dbstrap
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const renderYAML = `
+users:
+  - name: app_user
+    password_env: APP_PASSWORD
+    can_login: true
+    roles: [readonly_role]
+databases:
+  - name: app_db
+    owner: app_user
+    encoding: UTF8
+    extensions: ["uuid-ossp"]
+    grants:
+      - user: app_user
+        privileges: [CONNECT]
+    schemas:
+      - name: app
+        owner: app_user
+        grants:
+          - role: readonly_role
+            privileges: [USAGE]
+            table_privileges: [SELECT]
+  - name: empty_db
+`
+
+// TestRenderSQL tests that the rendered script guards creation and switches
+// databases with \connect
+func TestRenderSQL(t *testing.T) {
+	var config Config
+	require.NoError(t, parseConfig([]byte(renderYAML), &config))
+	config.Users[0].Password = "it's secret"
+
+	var b strings.Builder
+	require.NoError(t, renderSQL(&b, &config, false))
+	script := b.String()
+
+	assert.Contains(t, script, "\\set ON_ERROR_STOP on\n")
+	assert.Contains(t, script, "DO $dbstrap$\nBEGIN\n\tIF NOT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'app_user') THEN\n")
+	assert.Contains(t, script, "PASSWORD 'it''s secret'")
+	assert.Contains(t, script, "GRANT readonly_role TO app_user;\n")
+	assert.Contains(t, script, "SELECT 'CREATE DATABASE app_db OWNER app_user ENCODING ''UTF8'''\n"+
+		"WHERE NOT EXISTS (SELECT 1 FROM pg_database WHERE datname = 'app_db')\\gexec\n")
+	assert.Contains(t, script, "GRANT CONNECT ON DATABASE app_db TO app_user;\n")
+	assert.Contains(t, script, "\n\\connect app_db\nCREATE EXTENSION IF NOT EXISTS \"uuid-ossp\";\n")
+	assert.Contains(t, script, "GRANT SELECT ON ALL TABLES IN SCHEMA app TO readonly_role;\n")
+	assert.NotContains(t, script, "\\connect empty_db", "databases without extensions or schemas need no connection")
+
+	// Existing databases and schemas are transferred too
+	assert.Contains(t, script, "WHERE datname = 'app_db')\\gexec\nALTER DATABASE app_db OWNER TO app_user;\n")
+	assert.Contains(t, script, "CREATE SCHEMA IF NOT EXISTS app AUTHORIZATION app_user;\nALTER SCHEMA app OWNER TO app_user;\n")
+	assert.NotContains(t, script, "ALTER DATABASE empty_db OWNER")
+
+	// Everything inside a database comes after its \connect
+	assert.Less(t, strings.Index(script, "\\connect app_db"), strings.Index(script, "CREATE SCHEMA"))
+}
+
+// TestRenderSQLPasswordVars tests that passwords can be left as psql variables
+func TestRenderSQLPasswordVars(t *testing.T) {
+	var config Config
+	require.NoError(t, parseConfig([]byte(renderYAML), &config))
+
+	var b strings.Builder
+	require.NoError(t, renderSQL(&b, &config, true))
+	script := b.String()
+
+	assert.Contains(t, script, "-- Run with: psql -v APP_PASSWORD=... -f <this file>\n")
+	assert.Contains(t, script, "SELECT 'CREATE ROLE app_user WITH LOGIN PASSWORD ' || quote_literal(:'APP_PASSWORD')\n"+
+		"WHERE NOT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'app_user')\\gexec\n")
+	assert.NotContains(t, script, "DO $dbstrap$")
+
+	// Other sources would be written in cleartext
+	config.Users = append(config.Users, User{Name: "reporting", CanLogin: true, PasswordFile: "/run/secrets/reporting", Password: "s3cret"})
+	b.Reset()
+	err := renderSQL(&b, &config, true)
+	assert.EqualError(t, err, "user reporting: only passwords from password_env can be left as psql variables; "+
+		"unset BOOTSTRAP_PASSWORD_VARS to write the others into the script")
+	assert.NotContains(t, b.String(), "s3cret")
+}
+
+// TestRenderSQLOwnsSchemas tests that schemas owned through owns_schemas are
+// transferred even when they already exist
+func TestRenderSQLOwnsSchemas(t *testing.T) {
+	config, err := loadConfig([]byte(`
+users:
+  - name: app_user
+    can_login: true
+    owns_schemas: [public]
+databases:
+  - name: app_db
+    schemas:
+      - name: public
+`))
+	require.NoError(t, err)
+
+	var b strings.Builder
+	require.NoError(t, renderSQL(&b, config, false))
+	assert.Contains(t, b.String(), "CREATE SCHEMA IF NOT EXISTS public AUTHORIZATION app_user;\nALTER SCHEMA public OWNER TO app_user;\n")
+}
+
+// TestRenderSQLGuardsObjects tests that grants on individual objects, column
+// grants and row security are rendered for objects that may not exist yet
+func TestRenderSQLGuardsObjects(t *testing.T) {
+	var config Config
+	require.NoError(t, parseConfig([]byte(`
+databases:
+  - name: app_db
+    schemas:
+      - name: app
+        grants:
+          - role: app_user
+            objects:
+              - type: table
+                name: events
+                privileges: [SELECT]
+              - type: function
+                name: log_event
+                args: "text, int"
+                privileges: [EXECUTE]
+        column_grants:
+          - role: app_user
+            table: accounts
+            columns: [id]
+            privileges: [SELECT]
+        row_security:
+          - table: events
+            enable: true
+            policies:
+              - name: tenant
+                using: "tenant_id = 1"
+`), &config))
+
+	var b strings.Builder
+	require.NoError(t, renderSQL(&b, &config, false))
+	script := b.String()
+
+	assert.Contains(t, script, "DO $dbstrap$\nBEGIN\n\tIF to_regclass('app.events') IS NOT NULL THEN\n"+
+		"\t\tGRANT SELECT ON TABLE app.events TO app_user;\n\tEND IF;\nEND\n$dbstrap$;\n")
+	assert.Contains(t, script, "\tIF to_regprocedure('app.log_event(text, int)') IS NOT NULL THEN\n"+
+		"\t\tEXECUTE 'GRANT EXECUTE ON FUNCTION ' || to_regprocedure('app.log_event(text, int)') || ' TO app_user';\n")
+	assert.Contains(t, script, "\tIF to_regclass('app.accounts') IS NOT NULL THEN\n"+
+		"\t\tGRANT SELECT (id) ON TABLE app.accounts TO app_user;\n")
+	assert.Contains(t, script, "\tIF to_regclass('app.events') IS NOT NULL THEN\n"+
+		"\t\tALTER TABLE app.events ENABLE ROW LEVEL SECURITY;\n"+
+		"\t\tIF NOT EXISTS (SELECT 1 FROM pg_policies WHERE schemaname = 'app' AND tablename = 'events' AND policyname = 'tenant') THEN\n"+
+		"\t\t\tCREATE POLICY tenant ON app.events AS PERMISSIVE FOR ALL TO PUBLIC USING (tenant_id = 1);\n"+
+		"\t\tELSE\n"+
+		"\t\t\tALTER POLICY tenant ON app.events TO PUBLIC USING (tenant_id = 1);\n"+
+		"\t\tEND IF;\n")
+
+	// Grants on individual objects come after the schema is created
+	assert.Less(t, strings.Index(script, "CREATE SCHEMA"), strings.Index(script, "to_regclass"))
+}
@@ -32,8 +32,17 @@ func TestSchemaGrants(t *testing.T) {
 	os.Setenv("TEST_USER_PASSWORD", "testpass123")
 	defer os.Unsetenv("TEST_USER_PASSWORD")
 
+	ctx := context.Background()
+
+	// Use a timestamp suffix to create unique role names for this test run
+	timeStamp := time.Now().UnixNano()
+	roleName := fmt.Sprintf("grant_readonly_role_%d", timeStamp)
+
 	// Create test config with all the new grant types
-	yamlData := []byte(`
+	yamlData := []byte(fmt.Sprintf(`
+roles:
+  - name: %[1]s
+
 users:
   - name: grant_test_user
     password_env: TEST_USER_PASSWORD
@@ -45,7 +54,7 @@ users:
     password_env: TEST_USER_PASSWORD
     can_login: true
     owns_schemas: []
-    roles: [" + roleName + "]
+    roles: [%[1]s]
 
 databases:
   - name: grant_test_db
@@ -69,30 +78,16 @@ databases:
             sequence_privileges: [USAGE, SELECT, UPDATE]
             function_privileges: [EXECUTE]
             default_privileges: [SELECT, INSERT, UPDATE, DELETE]
-          - role: " + roleName + "
+          - role: %[1]s
             privileges: [USAGE]
             table_privileges: [SELECT]
             sequence_privileges: [USAGE, SELECT]
             function_privileges: [EXECUTE]
             default_privileges: [SELECT]
-`)
+`, roleName))
 
-	// Connect to create the role first
-	ctx := context.Background()
-	setupConn, err := pgx.Connect(ctx, dbURL)
-	require.NoError(t, err)
-	
-	// Use a timestamp suffix to create unique role names for this test run
-	timeStamp := time.Now().UnixNano()
-	roleName := fmt.Sprintf("grant_readonly_role_%d", timeStamp)
-	
-	// Create the readonly role (since bootstrap doesn't handle roles yet)
-	_, err = setupConn.Exec(ctx, fmt.Sprintf("CREATE ROLE %s", roleName))
-	require.NoError(t, err)
-	setupConn.Close(ctx)
-	
 	// Now run bootstrap
-	err = BootstrapDatabase(yamlData)
+	err := BootstrapDatabase(yamlData)
 	require.NoError(t, err)
 
 	// Connect to the test database
@@ -0,0 +1,681 @@
+package dbstrap
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Statement builders shared by the planner and the SQL script renderer. Every
+// name is quoted with quoteIdent, every value with quoteLiteral, and every
+// privilege keyword is checked by privilegeList, so nothing from the config
+// reaches the server unescaped.
+
+// reservedKeywords are the PostgreSQL keywords that cannot be used as bare
+// identifiers
+var reservedKeywords = map[string]bool{}
+
+func init() {
+	for _, k := range strings.Fields(`all analyse analyze and any array as asc asymmetric
+		authorization binary both case cast check collate collation column concurrently
+		constraint create cross current_catalog current_date current_role current_schema
+		current_time current_timestamp current_user default deferrable desc distinct do
+		else end except false fetch for foreign freeze from full grant group having ilike
+		in initially inner intersect into is isnull join lateral leading left like limit
+		localtime localtimestamp natural not notnull null offset on only or order outer
+		overlaps placing primary references returning right select session_user similar
+		some symmetric system_user table tablesample then to trailing true union unique
+		user using variadic verbose when where window with`) {
+		reservedKeywords[k] = true
+	}
+}
+
+// quoteIdent quotes name as an SQL identifier unless it is a lower-case name
+// that PostgreSQL would accept bare
+func quoteIdent(name string) string {
+	simple := name != "" && !reservedKeywords[name]
+	for i, r := range name {
+		if !(r >= 'a' && r <= 'z' || r == '_' || i > 0 && (r >= '0' && r <= '9' || r == '$')) {
+			simple = false
+			break
+		}
+	}
+	if simple {
+		return name
+	}
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// quoteLiteral quotes s as an SQL string literal, switching to an escape
+// string when s contains backslashes so the result is safe regardless of
+// standard_conforming_strings
+func quoteLiteral(s string) string {
+	quoted := "'" + strings.ReplaceAll(s, "'", "''") + "'"
+	if strings.Contains(s, `\`) {
+		return "E" + strings.ReplaceAll(quoted, `\`, `\\`)
+	}
+	return quoted
+}
+
+// quoteGrantee quotes a role name in a grant, keeping the PUBLIC pseudo-role
+// as a keyword
+func quoteGrantee(name string) string {
+	if strings.EqualFold(name, "public") {
+		return "PUBLIC"
+	}
+	return quoteIdent(name)
+}
+
+// privilegeList validates privileges against those valid for kind and joins
+// them for use in GRANT
+func privilegeList(kind objectKind, privileges []string) (string, error) {
+	if len(privileges) == 0 {
+		return "", fmt.Errorf("no %s privileges specified", kind)
+	}
+	normalized := make([]string, 0, len(privileges))
+	for _, p := range privileges {
+		keyword := strings.ToUpper(strings.Join(strings.Fields(p), " "))
+		if !validPrivilege(kind, keyword) {
+			return "", fmt.Errorf("invalid %s privilege %q", kind, p)
+		}
+		normalized = append(normalized, keyword)
+	}
+	return strings.Join(normalized, ", "), nil
+}
+
+// validPrivilege reports whether keyword may be granted on objects of kind
+func validPrivilege(kind objectKind, keyword string) bool {
+	switch keyword {
+	case "ALL", "ALL PRIVILEGES":
+		return true
+	case "TEMP":
+		return kind == kindDatabase
+	case "MAINTAIN":
+		return kind == kindTable
+	}
+	for _, p := range objectPrivileges[kind] {
+		if p == keyword {
+			return true
+		}
+	}
+	return false
+}
+
+// validUntilLayouts are the accepted valid_until formats besides "infinity"
+var validUntilLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// normalizeValidUntil converts a valid_until value to the form inspectCluster
+// reports, RFC 3339 in UTC. Values it can't parse are returned unchanged and
+// left for the server to reject.
+func normalizeValidUntil(v string) string {
+	if strings.EqualFold(v, "infinity") {
+		return "infinity"
+	}
+	for _, layout := range validUntilLayouts {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t.UTC().Format(time.RFC3339)
+		}
+	}
+	return v
+}
+
+// options returns the role options that differ from current, or every declared
+// option when current is nil
+func (a RoleAttributes) options(current *roleState) []string {
+	have := roleState{inherit: true, connLimit: -1}
+	if current != nil {
+		have = *current
+	}
+
+	var opts []string
+	flag := func(want *bool, has bool, keyword string) {
+		if want == nil || current != nil && *want == has {
+			return
+		}
+		if *want {
+			opts = append(opts, keyword)
+		} else {
+			opts = append(opts, "NO"+keyword)
+		}
+	}
+	flag(a.Superuser, have.superuser, "SUPERUSER")
+	flag(a.CreateDB, have.createDB, "CREATEDB")
+	flag(a.CreateRole, have.createRole, "CREATEROLE")
+	flag(a.Replication, have.replication, "REPLICATION")
+	flag(a.BypassRLS, have.bypassRLS, "BYPASSRLS")
+	flag(a.Inherit, have.inherit, "INHERIT")
+
+	if a.ConnectionLimit != nil && (current == nil || *a.ConnectionLimit != have.connLimit) {
+		opts = append(opts, fmt.Sprintf("CONNECTION LIMIT %d", *a.ConnectionLimit))
+	}
+	if a.ValidUntil != "" {
+		validUntil := normalizeValidUntil(a.ValidUntil)
+		if current == nil || validUntil != have.validUntil {
+			opts = append(opts, "VALID UNTIL "+quoteLiteral(validUntil))
+		}
+	}
+	return opts
+}
+
+// createRoleSQL builds CREATE ROLE; password is set when non-empty on roles
+// that can log in
+func createRoleSQL(name string, canLogin bool, attrs RoleAttributes, password string) string {
+	var opts []string
+	if canLogin {
+		opts = append(opts, "LOGIN")
+	}
+	opts = append(opts, attrs.options(nil)...)
+	if canLogin && password != "" {
+		opts = append(opts, "PASSWORD "+quoteLiteral(password))
+	}
+
+	createCmd := "CREATE ROLE " + quoteIdent(name)
+	if len(opts) > 0 {
+		createCmd += " WITH " + strings.Join(opts, " ")
+	}
+	return createCmd
+}
+
+func alterRoleSQL(name string, opts []string) string {
+	return fmt.Sprintf("ALTER ROLE %s WITH %s", quoteIdent(name), strings.Join(opts, " "))
+}
+
+func alterRolePasswordSQL(name, password string) string {
+	return fmt.Sprintf("ALTER ROLE %s WITH PASSWORD %s", quoteIdent(name), quoteLiteral(password))
+}
+
+func grantRoleSQL(role, member string) string {
+	return fmt.Sprintf("GRANT %s TO %s", quoteIdent(role), quoteIdent(member))
+}
+
+func createDatabaseSQL(db Database) string {
+	createCmd := "CREATE DATABASE " + quoteIdent(db.Name)
+	if db.Owner != "" {
+		createCmd += " OWNER " + quoteIdent(db.Owner)
+	}
+	if db.Encoding != "" {
+		createCmd += " ENCODING " + quoteLiteral(db.Encoding)
+	}
+	if db.LcCollate != "" {
+		createCmd += " LC_COLLATE " + quoteLiteral(db.LcCollate)
+	}
+	if db.LcCtype != "" {
+		createCmd += " LC_CTYPE " + quoteLiteral(db.LcCtype)
+	}
+	if db.LocaleProvider != "" {
+		createCmd += " LOCALE_PROVIDER " + quoteIdent(strings.ToLower(db.LocaleProvider))
+	}
+	if db.IcuLocale != "" {
+		createCmd += " ICU_LOCALE " + quoteLiteral(db.IcuLocale)
+	}
+	if db.CollationVersion != "" {
+		createCmd += " COLLATION_VERSION " + quoteLiteral(db.CollationVersion)
+	}
+	if db.Template != "" {
+		createCmd += " TEMPLATE " + quoteIdent(db.Template)
+	}
+	if db.Tablespace != "" {
+		createCmd += " TABLESPACE " + quoteIdent(db.Tablespace)
+	}
+	if db.AllowConnections != nil {
+		createCmd += fmt.Sprintf(" ALLOW_CONNECTIONS %t", *db.AllowConnections)
+	}
+	if db.ConnectionLimit != nil {
+		createCmd += fmt.Sprintf(" CONNECTION LIMIT %d", *db.ConnectionLimit)
+	}
+	if db.IsTemplate != nil {
+		createCmd += fmt.Sprintf(" IS_TEMPLATE %t", *db.IsTemplate)
+	}
+	return createCmd
+}
+
+// alterDatabaseSQL changes one option of an existing database, such as
+// CONNECTION LIMIT 10
+func alterDatabaseSQL(db, option string) string {
+	return fmt.Sprintf("ALTER DATABASE %s WITH %s", quoteIdent(db), option)
+}
+
+func alterDatabaseTablespaceSQL(db, tablespace string) string {
+	return fmt.Sprintf("ALTER DATABASE %s SET TABLESPACE %s", quoteIdent(db), quoteIdent(tablespace))
+}
+
+func grantDatabaseSQL(privileges []string, db, grantee string) (string, error) {
+	list, err := privilegeList(kindDatabase, privileges)
+	if err != nil {
+		return "", fmt.Errorf("database %s: %w", db, err)
+	}
+	return fmt.Sprintf("GRANT %s ON DATABASE %s TO %s", list, quoteIdent(db), quoteGrantee(grantee)), nil
+}
+
+func createExtensionSQL(extension Extension) string {
+	sql := "CREATE EXTENSION IF NOT EXISTS " + quoteIdent(extension.Name)
+	if extension.Schema != "" {
+		sql += " SCHEMA " + quoteIdent(extension.Schema)
+	}
+	if extension.Version != "" {
+		sql += " VERSION " + quoteLiteral(extension.Version)
+	}
+	if extension.Cascade {
+		sql += " CASCADE"
+	}
+	return sql
+}
+
+func updateExtensionSQL(extension Extension) string {
+	return fmt.Sprintf("ALTER EXTENSION %s UPDATE TO %s", quoteIdent(extension.Name), quoteLiteral(extension.Version))
+}
+
+func createSchemaSQL(schema Schema) string {
+	createCmd := "CREATE SCHEMA IF NOT EXISTS " + quoteIdent(schema.Name)
+	if schema.Owner != "" {
+		createCmd += " AUTHORIZATION " + quoteIdent(schema.Owner)
+	}
+	return createCmd
+}
+
+func alterSchemaOwnerSQL(schema, owner string) string {
+	return fmt.Sprintf("ALTER SCHEMA %s OWNER TO %s", quoteIdent(schema), quoteIdent(owner))
+}
+
+func alterDatabaseOwnerSQL(db, owner string) string {
+	return fmt.Sprintf("ALTER DATABASE %s OWNER TO %s", quoteIdent(db), quoteIdent(owner))
+}
+
+// ownerKeywords maps pg_class kinds to the ALTER command that changes their
+// owner
+var ownerKeywords = map[string]string{
+	"r": "TABLE",
+	"p": "TABLE",
+	"v": "VIEW",
+	"m": "MATERIALIZED VIEW",
+	"f": "FOREIGN TABLE",
+	"S": "SEQUENCE",
+}
+
+// alterObjectOwnerSQL changes the owner of a relation or, with relkind empty,
+// of a function, procedure or aggregate
+func alterObjectOwnerSQL(relkind, schema, name, args, owner string) string {
+	ref := quoteIdent(schema) + "." + quoteIdent(name)
+	if relkind == "" {
+		return fmt.Sprintf("ALTER ROUTINE %s(%s) OWNER TO %s", ref, args, quoteIdent(owner))
+	}
+	return fmt.Sprintf("ALTER %s %s OWNER TO %s", ownerKeywords[relkind], ref, quoteIdent(owner))
+}
+
+func grantSchemaSQL(privileges []string, schema, grantee string) (string, error) {
+	list, err := privilegeList(kindSchema, privileges)
+	if err != nil {
+		return "", fmt.Errorf("schema %s: %w", schema, err)
+	}
+	return fmt.Sprintf("GRANT %s ON SCHEMA %s TO %s", list, quoteIdent(schema), quoteGrantee(grantee)), nil
+}
+
+// allObjectsKeywords maps object kinds to their GRANT ... ON ALL <keyword> form
+var allObjectsKeywords = map[objectKind]string{
+	kindTable:    "TABLES",
+	kindSequence: "SEQUENCES",
+	kindFunction: "FUNCTIONS",
+	kindType:     "TYPES",
+}
+
+func grantAllInSchemaSQL(privileges []string, kind objectKind, schema, grantee string) (string, error) {
+	list, err := privilegeList(kind, privileges)
+	if err != nil {
+		return "", fmt.Errorf("schema %s: %w", schema, err)
+	}
+	return fmt.Sprintf("GRANT %s ON ALL %s IN SCHEMA %s TO %s",
+		list, allObjectsKeywords[kind], quoteIdent(schema), quoteGrantee(grantee)), nil
+}
+
+// defaultPrivilegesSQL builds ALTER DEFAULT PRIVILEGES for objects of kind
+// created in schema by forRole, or by the current user when forRole is empty,
+// as in rendered scripts
+func defaultPrivilegesSQL(forRole, schema string, privileges []string, kind objectKind, grantee string) (string, error) {
+	list, err := privilegeList(kind, privileges)
+	if err != nil {
+		return "", fmt.Errorf("schema %s default privileges: %w", schema, err)
+	}
+	alterCmd := "ALTER DEFAULT PRIVILEGES"
+	if forRole != "" {
+		alterCmd += " FOR ROLE " + quoteIdent(forRole)
+	}
+	return fmt.Sprintf("%s IN SCHEMA %s GRANT %s ON %s TO %s",
+		alterCmd, quoteIdent(schema), list, allObjectsKeywords[kind], quoteGrantee(grantee)), nil
+}
+
+// objectKeywords maps object kinds to the keyword used to name a single object
+// in GRANT and REVOKE
+var objectKeywords = map[objectKind]string{
+	kindTable:    "TABLE",
+	kindSequence: "SEQUENCE",
+	kindFunction: "FUNCTION",
+}
+
+// objectSQL names a single object in schema; args is the identity argument
+// list of a function
+func objectSQL(kind objectKind, schema, name, args string) string {
+	ref := objectKeywords[kind] + " " + quoteIdent(schema) + "." + quoteIdent(name)
+	if kind == kindFunction {
+		ref += "(" + args + ")"
+	}
+	return ref
+}
+
+func grantObjectSQL(privileges []string, kind objectKind, schema, name, args, grantee string) (string, error) {
+	list, err := privilegeList(kind, privileges)
+	if err != nil {
+		return "", fmt.Errorf("%s %s.%s: %w", kind, schema, name, err)
+	}
+	return fmt.Sprintf("GRANT %s ON %s TO %s", list, objectSQL(kind, schema, name, args), quoteGrantee(grantee)), nil
+}
+
+func revokeDatabaseSQL(privileges []string, db, grantee string) (string, error) {
+	list, err := privilegeList(kindDatabase, privileges)
+	if err != nil {
+		return "", fmt.Errorf("database %s: %w", db, err)
+	}
+	return fmt.Sprintf("REVOKE %s ON DATABASE %s FROM %s", list, quoteIdent(db), quoteGrantee(grantee)), nil
+}
+
+func revokeSchemaSQL(privileges []string, schema, grantee string) (string, error) {
+	list, err := privilegeList(kindSchema, privileges)
+	if err != nil {
+		return "", fmt.Errorf("schema %s: %w", schema, err)
+	}
+	return fmt.Sprintf("REVOKE %s ON SCHEMA %s FROM %s", list, quoteIdent(schema), quoteGrantee(grantee)), nil
+}
+
+func revokeObjectSQL(privileges []string, kind objectKind, schema, name, args, grantee string) (string, error) {
+	list, err := privilegeList(kind, privileges)
+	if err != nil {
+		return "", fmt.Errorf("%s %s.%s: %w", kind, schema, name, err)
+	}
+	return fmt.Sprintf("REVOKE %s ON %s FROM %s", list, objectSQL(kind, schema, name, args), quoteGrantee(grantee)), nil
+}
+
+func revokeDefaultPrivilegesSQL(forRole, schema string, privileges []string, kind objectKind, grantee string) (string, error) {
+	list, err := privilegeList(kind, privileges)
+	if err != nil {
+		return "", fmt.Errorf("schema %s default privileges: %w", schema, err)
+	}
+	return fmt.Sprintf("ALTER DEFAULT PRIVILEGES FOR ROLE %s IN SCHEMA %s REVOKE %s ON %s FROM %s",
+		quoteIdent(forRole), quoteIdent(schema), list, allObjectsKeywords[kind], quoteGrantee(grantee)), nil
+}
+
+// schemaGrantee returns the user or role a schema grant applies to
+func schemaGrantee(grant SchemaGrant) (string, error) {
+	return userOrRole("schema grant", grant.User, grant.Role)
+}
+
+// userOrRole returns the grantee of a grant that names a user or a role
+func userOrRole(what, user, role string) (string, error) {
+	if user != "" {
+		return user, nil
+	}
+	if role != "" {
+		return role, nil
+	}
+	return "", fmt.Errorf("%s must specify either user or role", what)
+}
+
+func dropRoleSQL(role string) string {
+	return "DROP ROLE IF EXISTS " + quoteIdent(role)
+}
+
+func dropDatabaseSQL(db string) string {
+	return "DROP DATABASE IF EXISTS " + quoteIdent(db)
+}
+
+// dropSchemaSQL never cascades, so a schema that still holds objects is kept
+func dropSchemaSQL(schema string) string {
+	return "DROP SCHEMA IF EXISTS " + quoteIdent(schema)
+}
+
+func dropExtensionSQL(ext string) string {
+	return "DROP EXTENSION IF EXISTS " + quoteIdent(ext)
+}
+
+// reassignOwnedSQL hands the objects role owns to newOwner, or to the
+// connecting user when newOwner is empty
+func reassignOwnedSQL(role, newOwner string) string {
+	target := "CURRENT_USER"
+	if newOwner != "" {
+		target = quoteIdent(newOwner)
+	}
+	return fmt.Sprintf("REASSIGN OWNED BY %s TO %s", quoteIdent(role), target)
+}
+
+func dropOwnedSQL(role string) string {
+	return "DROP OWNED BY " + quoteIdent(role)
+}
+
+// columnPrivilegeList pairs every privilege with the column list, as in
+// SELECT (a, b), UPDATE (a, b)
+func columnPrivilegeList(privileges, columns []string) (string, error) {
+	if len(columns) == 0 {
+		return "", fmt.Errorf("no columns specified")
+	}
+	if len(privileges) == 0 {
+		return "", fmt.Errorf("no %s privileges specified", kindColumn)
+	}
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = quoteIdent(column)
+	}
+	columnList := " (" + strings.Join(quoted, ", ") + ")"
+
+	parts := make([]string, 0, len(privileges))
+	for _, p := range privileges {
+		keyword, err := privilegeList(kindColumn, []string{p})
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, keyword+columnList)
+	}
+	return strings.Join(parts, ", "), nil
+}
+
+func grantColumnsSQL(privileges []string, schema, table string, columns []string, grantee string) (string, error) {
+	list, err := columnPrivilegeList(privileges, columns)
+	if err != nil {
+		return "", fmt.Errorf("table %s.%s: %w", schema, table, err)
+	}
+	return fmt.Sprintf("GRANT %s ON %s TO %s", list, objectSQL(kindTable, schema, table, ""), quoteGrantee(grantee)), nil
+}
+
+func revokeColumnsSQL(privileges []string, schema, table string, columns []string, grantee string) (string, error) {
+	list, err := columnPrivilegeList(privileges, columns)
+	if err != nil {
+		return "", fmt.Errorf("table %s.%s: %w", schema, table, err)
+	}
+	return fmt.Sprintf("REVOKE %s ON %s FROM %s", list, objectSQL(kindTable, schema, table, ""), quoteGrantee(grantee)), nil
+}
+
+// rowSecuritySQL turns row-level security on or off for a table
+func rowSecuritySQL(schema, table string, enable bool) string {
+	action := "DISABLE"
+	if enable {
+		action = "ENABLE"
+	}
+	return fmt.Sprintf("ALTER TABLE %s.%s %s ROW LEVEL SECURITY", quoteIdent(schema), quoteIdent(table), action)
+}
+
+// forceRowSecuritySQL sets whether row-level security applies to the table
+// owner
+func forceRowSecuritySQL(schema, table string, force bool) string {
+	action := "NO FORCE"
+	if force {
+		action = "FORCE"
+	}
+	return fmt.Sprintf("ALTER TABLE %s.%s %s ROW LEVEL SECURITY", quoteIdent(schema), quoteIdent(table), action)
+}
+
+// policyRoles lists the roles of a policy for CREATE and ALTER POLICY
+func policyRoles(policy Policy) string {
+	roles := policy.roles()
+	for i, role := range roles {
+		roles[i] = quoteGrantee(role)
+	}
+	return strings.Join(roles, ", ")
+}
+
+// policyClauses renders the USING and WITH CHECK clauses of a policy; the
+// expressions are SQL taken from the config as they are
+func policyClauses(policy Policy) string {
+	var clauses string
+	if policy.Using != "" {
+		clauses += " USING (" + policy.Using + ")"
+	}
+	if policy.WithCheck != "" {
+		clauses += " WITH CHECK (" + policy.WithCheck + ")"
+	}
+	return clauses
+}
+
+func createPolicySQL(schema, table string, policy Policy) string {
+	kind := "PERMISSIVE"
+	if policy.Restrictive {
+		kind = "RESTRICTIVE"
+	}
+	return fmt.Sprintf("CREATE POLICY %s ON %s.%s AS %s FOR %s TO %s%s",
+		quoteIdent(policy.Name), quoteIdent(schema), quoteIdent(table), kind, policy.command(), policyRoles(policy), policyClauses(policy))
+}
+
+func alterPolicySQL(schema, table string, policy Policy) string {
+	return fmt.Sprintf("ALTER POLICY %s ON %s.%s TO %s%s",
+		quoteIdent(policy.Name), quoteIdent(schema), quoteIdent(table), policyRoles(policy), policyClauses(policy))
+}
+
+func dropPolicySQL(schema, table, name string) string {
+	return fmt.Sprintf("DROP POLICY IF EXISTS %s ON %s.%s", quoteIdent(name), quoteIdent(schema), quoteIdent(table))
+}
+
+// listSettings are the parameters whose value is a list; each element is
+// quoted on its own
+var listSettings = map[string]bool{
+	"search_path":               true,
+	"temp_tablespaces":          true,
+	"session_preload_libraries": true,
+	"local_preload_libraries":   true,
+}
+
+// settingElements splits the value of a list parameter, removing the double
+// quotes around elements such as "$user"
+func settingElements(value string) []string {
+	var elements []string
+	for _, element := range strings.Split(value, ",") {
+		element = strings.TrimSpace(element)
+		if len(element) >= 2 && strings.HasPrefix(element, `"`) && strings.HasSuffix(element, `"`) {
+			element = strings.ReplaceAll(element[1:len(element)-1], `""`, `"`)
+		}
+		elements = append(elements, element)
+	}
+	return elements
+}
+
+// storedSetting returns a parameter value the way pg_db_role_setting records
+// it, so configured and current values can be compared
+func storedSetting(name, value string) string {
+	if !listSettings[strings.ToLower(name)] {
+		return value
+	}
+	elements := settingElements(value)
+	for i, element := range elements {
+		elements[i] = quoteIdent(element)
+	}
+	return strings.Join(elements, ", ")
+}
+
+// settingName quotes a parameter name, which may be qualified with a dot
+// like app.tenant
+func settingName(name string) string {
+	parts := strings.Split(strings.ToLower(name), ".")
+	for i, part := range parts {
+		parts[i] = quoteIdent(part)
+	}
+	return strings.Join(parts, ".")
+}
+
+// settingTarget is the ALTER statement a setting for role in database belongs
+// to; either may be empty but not both
+func settingTarget(role, database string) string {
+	switch {
+	case role == "":
+		return "ALTER DATABASE " + quoteIdent(database)
+	case database == "":
+		return "ALTER ROLE " + quoteIdent(role)
+	default:
+		return fmt.Sprintf("ALTER ROLE %s IN DATABASE %s", quoteIdent(role), quoteIdent(database))
+	}
+}
+
+func setSettingSQL(role, database, name, value string) string {
+	var literals []string
+	if listSettings[strings.ToLower(name)] {
+		for _, element := range settingElements(value) {
+			literals = append(literals, quoteLiteral(element))
+		}
+	} else {
+		literals = []string{quoteLiteral(value)}
+	}
+	return fmt.Sprintf("%s SET %s = %s", settingTarget(role, database), settingName(name), strings.Join(literals, ", "))
+}
+
+func resetSettingSQL(role, database, name string) string {
+	return fmt.Sprintf("%s RESET %s", settingTarget(role, database), settingName(name))
+}
+
+func createTablespaceSQL(tablespace Tablespace) string {
+	createCmd := "CREATE TABLESPACE " + quoteIdent(tablespace.Name)
+	if tablespace.Owner != "" {
+		createCmd += " OWNER " + quoteIdent(tablespace.Owner)
+	}
+	createCmd += " LOCATION " + quoteLiteral(tablespace.Location)
+	if len(tablespace.Options) > 0 {
+		createCmd += " WITH (" + tablespaceOptions(tablespace.Options) + ")"
+	}
+	return createCmd
+}
+
+// tablespaceOptions lists options as name = value pairs in name order
+func tablespaceOptions(options map[string]string) string {
+	pairs := make([]string, 0, len(options))
+	for _, name := range sortedKeys(options) {
+		pairs = append(pairs, quoteIdent(strings.ToLower(name))+" = "+quoteLiteral(options[name]))
+	}
+	return strings.Join(pairs, ", ")
+}
+
+func alterTablespaceOwnerSQL(tablespace, owner string) string {
+	return fmt.Sprintf("ALTER TABLESPACE %s OWNER TO %s", quoteIdent(tablespace), quoteIdent(owner))
+}
+
+func setTablespaceOptionSQL(tablespace, name, value string) string {
+	return fmt.Sprintf("ALTER TABLESPACE %s SET (%s)", quoteIdent(tablespace), tablespaceOptions(map[string]string{name: value}))
+}
+
+func resetTablespaceOptionSQL(tablespace, name string) string {
+	return fmt.Sprintf("ALTER TABLESPACE %s RESET (%s)", quoteIdent(tablespace), quoteIdent(name))
+}
+
+func grantTablespaceSQL(privileges []string, tablespace, grantee string) (string, error) {
+	list, err := privilegeList(kindTablespace, privileges)
+	if err != nil {
+		return "", fmt.Errorf("tablespace %s: %w", tablespace, err)
+	}
+	return fmt.Sprintf("GRANT %s ON TABLESPACE %s TO %s", list, quoteIdent(tablespace), quoteGrantee(grantee)), nil
+}
+
+func revokeTablespaceSQL(privileges []string, tablespace, grantee string) (string, error) {
+	list, err := privilegeList(kindTablespace, privileges)
+	if err != nil {
+		return "", fmt.Errorf("tablespace %s: %w", tablespace, err)
+	}
+	return fmt.Sprintf("REVOKE %s ON TABLESPACE %s FROM %s", list, quoteIdent(tablespace), quoteGrantee(grantee)), nil
+}
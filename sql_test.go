@@ -0,0 +1,111 @@
+package dbstrap
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestQuoteIdent tests identifier quoting
+func TestQuoteIdent(t *testing.T) {
+	tests := map[string]string{
+		"app_user":    "app_user",
+		"user1$":      "user1$",
+		"App":         `"App"`,
+		"app-user":    `"app-user"`,
+		"1app":        `"1app"`,
+		"user":        `"user"`,
+		"select":      `"select"`,
+		`x"; DROP --`: `"x""; DROP --"`,
+		"":            `""`,
+	}
+	for in, want := range tests {
+		assert.Equal(t, want, quoteIdent(in), in)
+	}
+}
+
+// TestQuoteLiteral tests string literal quoting
+func TestQuoteLiteral(t *testing.T) {
+	assert.Equal(t, "'secret'", quoteLiteral("secret"))
+	assert.Equal(t, "'it''s'", quoteLiteral("it's"))
+	assert.Equal(t, `E'a\\b'''`, quoteLiteral(`a\b'`))
+}
+
+// TestPrivilegeList tests privilege keyword validation
+func TestPrivilegeList(t *testing.T) {
+	list, err := privilegeList(kindTable, []string{"select", "Insert", "all  privileges"})
+	require.NoError(t, err)
+	assert.Equal(t, "SELECT, INSERT, ALL PRIVILEGES", list)
+
+	list, err = privilegeList(kindDatabase, []string{"CONNECT", "temp"})
+	require.NoError(t, err)
+	assert.Equal(t, "CONNECT, TEMP", list)
+
+	_, err = privilegeList(kindSchema, []string{"SELECT"})
+	assert.Error(t, err)
+
+	_, err = privilegeList(kindTable, []string{"SELECT ON x TO y; DROP TABLE z; --"})
+	assert.Error(t, err)
+
+	_, err = privilegeList(kindFunction, nil)
+	assert.Error(t, err)
+}
+
+// TestStatementQuoting tests that builders quote names and values
+func TestStatementQuoting(t *testing.T) {
+	user := User{Name: "Billing-Svc", CanLogin: true}
+	assert.Equal(t, `CREATE ROLE "Billing-Svc" WITH LOGIN PASSWORD 'p''w'`, createRoleSQL(user.Name, user.CanLogin, user.RoleAttributes, "p'w"))
+	assert.Equal(t, `GRANT "read-only" TO "Billing-Svc"`, grantRoleSQL("read-only", user.Name))
+
+	db := Database{Name: "Billing", Owner: "Billing-Svc", Encoding: "UTF8", Template: "template0"}
+	assert.Equal(t, `CREATE DATABASE "Billing" OWNER "Billing-Svc" ENCODING 'UTF8' TEMPLATE template0`, createDatabaseSQL(db))
+
+	db = Database{Name: "app", Encoding: "UTF8", LocaleProvider: "ICU", IcuLocale: "en-US", Template: "template0"}
+	assert.Equal(t, `CREATE DATABASE app ENCODING 'UTF8' LOCALE_PROVIDER icu ICU_LOCALE 'en-US' TEMPLATE template0`, createDatabaseSQL(db))
+
+	grantCmd, err := grantDatabaseSQL([]string{"connect"}, "Billing", "public")
+	require.NoError(t, err)
+	assert.Equal(t, `GRANT CONNECT ON DATABASE "Billing" TO PUBLIC`, grantCmd)
+
+	tablespace := Tablespace{Name: "Fast-SSD", Location: "/mnt/o'ssd", Owner: "Billing-Svc", Options: map[string]string{"random_page_cost": "1.1"}}
+	assert.Equal(t, `CREATE TABLESPACE "Fast-SSD" OWNER "Billing-Svc" LOCATION '/mnt/o''ssd' WITH (random_page_cost = '1.1')`, createTablespaceSQL(tablespace))
+	grantCmd, err = grantTablespaceSQL([]string{"all"}, "Fast-SSD", "Billing-Svc")
+	require.NoError(t, err)
+	assert.Equal(t, `GRANT ALL ON TABLESPACE "Fast-SSD" TO "Billing-Svc"`, grantCmd)
+
+	assert.Equal(t, `CREATE SCHEMA IF NOT EXISTS "order" AUTHORIZATION app`, createSchemaSQL(Schema{Name: "order", Owner: "app"}))
+	assert.Equal(t, `CREATE SCHEMA IF NOT EXISTS app`, createSchemaSQL(Schema{Name: "app"}))
+
+	grantCmd, err = defaultPrivilegesSQL("", "app", []string{"SELECT"}, kindTable, "Reader")
+	require.NoError(t, err)
+	assert.Equal(t, `ALTER DEFAULT PRIVILEGES IN SCHEMA app GRANT SELECT ON TABLES TO "Reader"`, grantCmd)
+
+	_, err = grantAllInSchemaSQL([]string{"EXECUTE"}, kindSequence, "app", "reader")
+	assert.Error(t, err)
+
+	grantCmd, err = grantColumnsSQL([]string{"select", "update"}, "app", "Customers", []string{"id", "E-mail"}, "analytics")
+	require.NoError(t, err)
+	assert.Equal(t, `GRANT SELECT (id, "E-mail"), UPDATE (id, "E-mail") ON TABLE app."Customers" TO analytics`, grantCmd)
+
+	_, err = grantColumnsSQL([]string{"SELECT"}, "app", "customers", nil, "analytics")
+	assert.Error(t, err)
+
+	postgis := Extension{Name: "postgis", Version: "3.4.2", Schema: "gis", Cascade: true}
+	assert.Equal(t, `CREATE EXTENSION IF NOT EXISTS postgis SCHEMA gis VERSION '3.4.2' CASCADE`, createExtensionSQL(postgis))
+	assert.Equal(t, `ALTER EXTENSION postgis UPDATE TO '3.4.2'`, updateExtensionSQL(postgis))
+
+	assert.Equal(t, `ALTER ROLE "Billing-Svc" SET statement_timeout = '30s'`, setSettingSQL("Billing-Svc", "", "statement_timeout", "30s"))
+	assert.Equal(t, `ALTER DATABASE "Billing" SET app.tenant = 'it''s'`, setSettingSQL("", "Billing", "App.Tenant", "it's"))
+	assert.Equal(t, `ALTER ROLE app IN DATABASE "Billing" SET search_path = '$user', 'app'`, setSettingSQL("app", "Billing", "search_path", `"$user", app`))
+	assert.Equal(t, `ALTER ROLE app IN DATABASE "Billing" RESET work_mem`, resetSettingSQL("app", "Billing", "work_mem"))
+	assert.Equal(t, `"$user", app`, storedSetting("search_path", `"$user",app`))
+}
+
+// TestNormalizeValidUntil tests valid_until normalization
+func TestNormalizeValidUntil(t *testing.T) {
+	assert.Equal(t, "infinity", normalizeValidUntil("Infinity"))
+	assert.Equal(t, "2030-01-01T00:00:00Z", normalizeValidUntil("2030-01-01"))
+	assert.Equal(t, "2030-01-01T10:00:00Z", normalizeValidUntil("2030-01-01 12:00:00+02:00"))
+	assert.Equal(t, "next tuesday", normalizeValidUntil("next tuesday"))
+}
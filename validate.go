@@ -0,0 +1,489 @@
+package dbstrap
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Problem is an error in a configuration found by Validate
+type Problem struct {
+	Line    int
+	Message string
+}
+
+func (p Problem) Error() string {
+	if p.Line == 0 {
+		return p.Message
+	}
+	return fmt.Sprintf("line %d: %s", p.Line, p.Message)
+}
+
+var (
+	yamlErrorPattern    = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+	unknownFieldPattern = regexp.MustCompile(`^field (\S+) not found in type \S+$`)
+)
+
+// Validate parses yamlData strictly, rejecting unknown keys, and checks that
+// the configuration is consistent without connecting to a database. It returns
+// every problem found, ordered by line.
+func Validate(yamlData []byte) []Problem {
+	var root yaml.Node
+	if err := yaml.Unmarshal(yamlData, &root); err != nil {
+		return yamlProblems(err)
+	}
+
+	var config Config
+	decoder := yaml.NewDecoder(bytes.NewReader(yamlData))
+	decoder.KnownFields(true)
+	err := decoder.Decode(&config)
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	problems := yamlProblems(err)
+	var typeErr *yaml.TypeError
+	if err != nil && !errors.As(err, &typeErr) {
+		return problems
+	}
+
+	v := &validator{root: &root, config: &config, problems: problems}
+	v.checkNames()
+	v.checkExtensionKeys()
+	v.checkReferences()
+	v.checkPrivileges()
+	v.checkDatabaseProperties()
+	v.checkPasswords()
+	v.checkMembershipCycles()
+
+	sort.SliceStable(v.problems, func(i, j int) bool {
+		return v.problems[i].Line < v.problems[j].Line
+	})
+	return v.problems
+}
+
+// yamlProblems turns a decoding error into problems, one per line reported
+func yamlProblems(err error) []Problem {
+	if err == nil {
+		return nil
+	}
+	messages := []string{err.Error()}
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) {
+		messages = typeErr.Errors
+	}
+
+	problems := make([]Problem, 0, len(messages))
+	for _, msg := range messages {
+		problem := Problem{Message: strings.TrimPrefix(msg, "yaml: ")}
+		if m := yamlErrorPattern.FindStringSubmatch(msg); m != nil {
+			problem.Line, _ = strconv.Atoi(m[1])
+			problem.Message = m[2]
+		}
+		if m := unknownFieldPattern.FindStringSubmatch(problem.Message); m != nil {
+			problem.Message = fmt.Sprintf("unknown key %q", m[1])
+		}
+		problems = append(problems, problem)
+	}
+	return problems
+}
+
+type validator struct {
+	root     *yaml.Node
+	config   *Config
+	problems []Problem
+}
+
+// addf records a problem at the node found at path
+func (v *validator) addf(path []any, format string, args ...any) {
+	v.problems = append(v.problems, Problem{
+		Line:    configNode(v.root, path...).Line,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// configNode returns the node at path below root, where strings select
+// mapping keys and ints select sequence items. When the path ends early the
+// deepest node found is returned, so problems point as close to their cause
+// as the document allows.
+func configNode(root *yaml.Node, path ...any) *yaml.Node {
+	node := root
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	for _, step := range path {
+		var next *yaml.Node
+		switch key := step.(type) {
+		case string:
+			if node.Kind == yaml.MappingNode {
+				for i := 0; i+1 < len(node.Content); i += 2 {
+					if node.Content[i].Value == key {
+						next = node.Content[i+1]
+						break
+					}
+				}
+			}
+		case int:
+			if node.Kind == yaml.SequenceNode && key < len(node.Content) {
+				next = node.Content[key]
+			}
+		}
+		if next == nil {
+			break
+		}
+		node = next
+	}
+	return node
+}
+
+// path builds a configNode path
+func path(steps ...any) []any {
+	return steps
+}
+
+// defined reports whether name is a role the configuration may refer to:
+// declared roles and users, external roles and PostgreSQL's predefined pg_
+// roles
+func (v *validator) defined(name string) bool {
+	if strings.HasPrefix(name, "pg_") {
+		return true
+	}
+	for _, role := range v.config.Roles {
+		if role.Name == name {
+			return true
+		}
+	}
+	for _, user := range v.config.Users {
+		if user.Name == name {
+			return true
+		}
+	}
+	for _, external := range v.config.ExternalRoles {
+		if external == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkNames reports missing names and duplicate roles, users, tablespaces,
+// databases, extensions and schemas
+func (v *validator) checkNames() {
+	seen := map[string]bool{}
+	unique := func(kind, scope, name string, at []any) {
+		if name == "" {
+			v.addf(at, "%s without a name", kind)
+			return
+		}
+		key := kind + "\x00" + scope + "\x00" + name
+		if seen[key] {
+			v.addf(append(at, "name"), "duplicate %s %s", kind, name)
+		}
+		seen[key] = true
+	}
+
+	roleNames := map[string]bool{}
+	for i, role := range v.config.Roles {
+		unique("role", "", role.Name, path("roles", i))
+		roleNames[role.Name] = true
+	}
+	for i, user := range v.config.Users {
+		unique("user", "", user.Name, path("users", i))
+		if roleNames[user.Name] {
+			v.addf(path("users", i, "name"), "user %s is also declared as a role", user.Name)
+		}
+	}
+	for i, tablespace := range v.config.Tablespaces {
+		unique("tablespace", "", tablespace.Name, path("tablespaces", i))
+	}
+	for i, db := range v.config.Databases {
+		unique("database", "", db.Name, path("databases", i))
+		for j, extension := range db.Extensions {
+			unique("extension", db.Name, extension.Name, path("databases", i, "extensions", j))
+		}
+		for j, schema := range db.Schemas {
+			unique("schema", db.Name, schema.Name, path("databases", i, "schemas", j))
+		}
+	}
+}
+
+// checkExtensionKeys reports unknown keys in extension mappings, which the
+// decoder can't reject because extensions also accept a plain name
+func (v *validator) checkExtensionKeys() {
+	for i, db := range v.config.Databases {
+		for j := range db.Extensions {
+			node := configNode(v.root, "databases", i, "extensions", j)
+			if node.Kind != yaml.MappingNode {
+				continue
+			}
+			for k := 0; k+1 < len(node.Content); k += 2 {
+				key := node.Content[k]
+				known := false
+				for _, name := range extensionKeys {
+					known = known || key.Value == name
+				}
+				if !known {
+					v.problems = append(v.problems, Problem{Line: key.Line, Message: fmt.Sprintf("unknown key %q", key.Value)})
+				}
+			}
+		}
+	}
+}
+
+// checkReferences reports owners, grantees and granted roles that are not
+// defined, tablespaces without an absolute location, schema grants without
+// exactly one grantee and invalid policies
+func (v *validator) checkReferences() {
+	role := func(name string, at []any, what string) {
+		if name != "" && !v.defined(name) {
+			v.addf(at, "%s %s is not defined; declare it or list it in external_roles", what, name)
+		}
+	}
+	grantee := func(name string, at []any) {
+		if canonicalGrantee(name) != "PUBLIC" {
+			role(name, at, "grantee")
+		}
+	}
+	oneGrantee := func(what, user, role string, at []any) {
+		switch {
+		case user != "" && role != "":
+			v.addf(at, "%s must specify either user or role, not both", what)
+		case user == "" && role == "":
+			v.addf(at, "%s must specify either user or role", what)
+		case user != "":
+			grantee(user, append(at, "user"))
+		default:
+			grantee(role, append(at, "role"))
+		}
+	}
+
+	for i, r := range v.config.Roles {
+		for j, granted := range r.Roles {
+			role(granted, path("roles", i, "roles", j), "role")
+		}
+	}
+	for i, user := range v.config.Users {
+		for j, granted := range user.Roles {
+			role(granted, path("users", i, "roles", j), "role")
+		}
+	}
+	for i, tablespace := range v.config.Tablespaces {
+		if !strings.HasPrefix(tablespace.Location, "/") {
+			v.addf(path("tablespaces", i, "location"), "tablespace must specify an absolute location")
+		}
+		role(tablespace.Owner, path("tablespaces", i, "owner"), "owner")
+		for j, grant := range tablespace.Grants {
+			at := path("tablespaces", i, "grants", j)
+			if grant.User == "" {
+				v.addf(at, "tablespace grant must specify a user")
+			}
+			grantee(grant.User, append(at, "user"))
+		}
+	}
+	for i, db := range v.config.Databases {
+		role(db.Owner, path("databases", i, "owner"), "owner")
+		for _, name := range sortedKeys(db.RoleSettings) {
+			role(name, path("databases", i, "role_settings", name), "role")
+		}
+		for j, grant := range db.Grants {
+			at := path("databases", i, "grants", j)
+			if grant.User == "" {
+				v.addf(at, "database grant must specify a user")
+			}
+			grantee(grant.User, append(at, "user"))
+		}
+		for j, schema := range db.Schemas {
+			at := path("databases", i, "schemas", j)
+			role(schema.Owner, append(at, "owner"), "owner")
+			for k, creator := range schema.ForRoles {
+				role(creator, path("databases", i, "schemas", j, "for_roles", k), "role")
+			}
+			for k, grant := range schema.Grants {
+				at := path("databases", i, "schemas", j, "grants", k)
+				for l, creator := range grant.ForRoles {
+					role(creator, append(at, "for_roles", l), "role")
+				}
+				oneGrantee("schema grant", grant.User, grant.Role, at)
+			}
+			for k, grant := range schema.ColumnGrants {
+				at := path("databases", i, "schemas", j, "column_grants", k)
+				if grant.Table == "" {
+					v.addf(at, "column grant must specify a table")
+				}
+				if len(grant.Columns) == 0 {
+					v.addf(at, "column grant must specify columns")
+				}
+				oneGrantee("column grant", grant.User, grant.Role, at)
+			}
+			for k, rls := range schema.RowSecurity {
+				at := path("databases", i, "schemas", j, "row_security", k)
+				if rls.Table == "" {
+					v.addf(at, "row_security must specify a table")
+				}
+				for l, policy := range rls.Policies {
+					at := path("databases", i, "schemas", j, "row_security", k, "policies", l)
+					if err := policy.validate(); err != nil {
+						v.addf(at, "%v", err)
+					}
+					for m, name := range policy.Roles {
+						grantee(name, append(at, "roles", m))
+					}
+				}
+			}
+		}
+	}
+}
+
+// checkPrivileges reports privileges that cannot be granted on their object
+// type
+func (v *validator) checkPrivileges() {
+	check := func(kind objectKind, privileges []string, required bool, at []any) {
+		if len(privileges) == 0 && !required {
+			return
+		}
+		if _, err := privilegeList(kind, privileges); err != nil {
+			v.addf(at, "%v", err)
+		}
+	}
+
+	for i, tablespace := range v.config.Tablespaces {
+		for j, grant := range tablespace.Grants {
+			check(kindTablespace, grant.Privileges, true, path("tablespaces", i, "grants", j, "privileges"))
+		}
+	}
+	for i, db := range v.config.Databases {
+		for j, grant := range db.Grants {
+			check(kindDatabase, grant.Privileges, true, path("databases", i, "grants", j, "privileges"))
+		}
+		for j, schema := range db.Schemas {
+			for k, grant := range schema.Grants {
+				at := func(key string) []any { return path("databases", i, "schemas", j, "grants", k, key) }
+				check(kindSchema, grant.Privileges, false, at("privileges"))
+				check(kindTable, grant.TablePrivileges, false, at("table_privileges"))
+				check(kindSequence, grant.SequencePrivileges, false, at("sequence_privileges"))
+				check(kindFunction, grant.FunctionPrivileges, false, at("function_privileges"))
+				check(kindTable, grant.DefaultPrivileges, false, at("default_privileges"))
+				check(kindSequence, grant.DefaultSequencePrivileges, false, at("default_sequence_privileges"))
+				check(kindFunction, grant.DefaultFunctionPrivileges, false, at("default_function_privileges"))
+				check(kindType, grant.DefaultTypePrivileges, false, at("default_type_privileges"))
+				for l, object := range grant.Objects {
+					at := path("databases", i, "schemas", j, "grants", k, "objects", l)
+					if object.Name == "" {
+						v.addf(at, "object grant must specify a name")
+					}
+					kind, err := object.kind()
+					if err != nil {
+						v.addf(append(at, "type"), "%v", err)
+						continue
+					}
+					check(kind, object.Privileges, true, append(at, "privileges"))
+				}
+			}
+			for k, grant := range schema.ColumnGrants {
+				check(kindColumn, grant.Privileges, true, path("databases", i, "schemas", j, "column_grants", k, "privileges"))
+			}
+		}
+	}
+}
+
+// checkDatabaseProperties reports locale providers and connection limits
+// that CREATE DATABASE would reject
+func (v *validator) checkDatabaseProperties() {
+	for i, db := range v.config.Databases {
+		switch strings.ToLower(db.LocaleProvider) {
+		case "", "libc", "icu", "builtin":
+		default:
+			v.addf(path("databases", i, "locale_provider"), "invalid locale_provider %q; expected libc, icu or builtin", db.LocaleProvider)
+		}
+		if db.IcuLocale != "" && !strings.EqualFold(db.LocaleProvider, "icu") {
+			v.addf(path("databases", i, "icu_locale"), "icu_locale requires locale_provider: icu")
+		}
+		if db.ConnectionLimit != nil && *db.ConnectionLimit < -1 {
+			v.addf(path("databases", i, "connection_limit"), "invalid connection_limit %d; use -1 for no limit", *db.ConnectionLimit)
+		}
+	}
+}
+
+// checkPasswords reports users with more than one password source and
+// malformed Vault references
+func (v *validator) checkPasswords() {
+	for i, user := range v.config.Users {
+		var sources []string
+		if user.PasswordEnv != "" {
+			sources = append(sources, "password_env")
+		}
+		if user.PasswordFile != "" {
+			sources = append(sources, "password_file")
+		}
+		if len(user.PasswordCommand) > 0 {
+			sources = append(sources, "password_command")
+		}
+		if user.PasswordVault != "" {
+			sources = append(sources, "password_vault")
+			if _, _, err := splitVaultRef(user.PasswordVault); err != nil {
+				v.addf(path("users", i, "password_vault"), "%v", err)
+			}
+		}
+		if len(sources) > 1 {
+			v.addf(path("users", i, sources[1]), "user %s sets both %s and %s; use one password source", user.Name, sources[0], sources[1])
+		}
+	}
+}
+
+// checkMembershipCycles reports role memberships that would make a role a
+// member of itself
+func (v *validator) checkMembershipCycles() {
+	type edge struct {
+		role string
+		at   []any
+	}
+	edges := map[string][]edge{}
+	for i, role := range v.config.Roles {
+		for j, granted := range role.Roles {
+			edges[role.Name] = append(edges[role.Name], edge{granted, path("roles", i, "roles", j)})
+		}
+	}
+	for i, user := range v.config.Users {
+		for j, granted := range user.Roles {
+			edges[user.Name] = append(edges[user.Name], edge{granted, path("users", i, "roles", j)})
+		}
+	}
+
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := map[string]int{}
+	var stack []string
+	var visit func(name string)
+	visit = func(name string) {
+		state[name] = visiting
+		stack = append(stack, name)
+		for _, e := range edges[name] {
+			switch state[e.role] {
+			case visiting:
+				start := 0
+				for stack[start] != e.role {
+					start++
+				}
+				cycle := append(append([]string{}, stack[start:]...), e.role)
+				v.addf(e.at, "role membership cycle: %s", strings.Join(cycle, " -> "))
+			case 0:
+				visit(e.role)
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[name] = done
+	}
+	for _, name := range sortedKeys(edges) {
+		if state[name] == 0 {
+			visit(name)
+		}
+	}
+}
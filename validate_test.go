@@ -0,0 +1,96 @@
+package dbstrap
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestValidate tests that every problem in a config is reported with its line
+func TestValidate(t *testing.T) {
+	problems := Validate([]byte(`
+external_roles: [postgres]
+roles:
+  - name: app_readonly
+    roles: [app_readwrite]
+  - name: app_readwrite
+    roles: [app_readonly]
+users:
+  - name: app_user
+    can_login: true
+  - name: app_user
+    password_env: APP_PASSWORD
+    password_file: /run/secrets/app_password
+tablespaces:
+  - name: fast
+    location: ssd/fast
+    grants:
+      - user: app_user
+        privileges: [USAGE]
+databases:
+  - name: app
+    owner: postgres
+    locale_provider: glibc
+    extensions:
+      - pgcrypto
+      - name: postgis
+        versoin: "3.4.2"
+    grants:
+      - user: public
+        privileges: [CONNECT, SELECT]
+    schemas:
+      - name: app
+        owner: nobody
+        grants:
+          - user: app_user
+            role: app_readonly
+          - privilages: [USAGE]
+          - role: app_readonly
+            table_privileges: [EXECUTE]
+        row_security:
+          - table: orders
+            policies:
+              - name: own_orders
+                command: SELECT
+                with_check: "true"
+      - name: app
+`))
+
+	var got []string
+	for _, problem := range problems {
+		got = append(got, problem.Error())
+	}
+	assert.Equal(t, []string{
+		`line 7: role membership cycle: app_readonly -> app_readwrite -> app_readonly`,
+		`line 11: duplicate user app_user`,
+		`line 13: user app_user sets both password_env and password_file; use one password source`,
+		`line 16: tablespace must specify an absolute location`,
+		`line 19: invalid tablespace privilege "USAGE"`,
+		`line 23: invalid locale_provider "glibc"; expected libc, icu or builtin`,
+		`line 27: unknown key "versoin"`,
+		`line 30: invalid database privilege "SELECT"`,
+		`line 33: owner nobody is not defined; declare it or list it in external_roles`,
+		`line 35: schema grant must specify either user or role, not both`,
+		`line 37: unknown key "privilages"`,
+		`line 37: schema grant must specify either user or role`,
+		`line 39: invalid table privilege "EXECUTE"`,
+		`line 43: policy own_orders: SELECT policies can't have with_check`,
+		`line 46: duplicate schema app`,
+	}, got)
+}
+
+// TestValidateSample tests that the sample config is valid
+func TestValidateSample(t *testing.T) {
+	yamlData, err := os.ReadFile("samples/bootstrap.yaml")
+	require.NoError(t, err)
+	assert.Empty(t, Validate(yamlData))
+}
+
+// TestValidateSyntax tests that YAML syntax errors are reported with their line
+func TestValidateSyntax(t *testing.T) {
+	problems := Validate([]byte("users:\n  - name: a\n   bad: [\n"))
+	require.Len(t, problems, 1)
+	assert.NotZero(t, problems[0].Line)
+}
@@ -0,0 +1,150 @@
+package dbstrap
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// vaultClient reads secrets from HashiCorp Vault. It authenticates with
+// VAULT_TOKEN, or with an AppRole login using VAULT_ROLE_ID and
+// VAULT_SECRET_ID when no token is set.
+type vaultClient struct {
+	addr      string
+	namespace string
+	token     string
+	roleID    string
+	secretID  string
+	// approleMount is the path the AppRole auth method is enabled at
+	approleMount string
+	http         *http.Client
+}
+
+// newVaultClient configures a client from VAULT_ADDR, VAULT_NAMESPACE,
+// VAULT_TOKEN, VAULT_ROLE_ID, VAULT_SECRET_ID and VAULT_APPROLE_MOUNT
+func newVaultClient() (*vaultClient, error) {
+	c := &vaultClient{
+		addr:         strings.TrimRight(os.Getenv("VAULT_ADDR"), "/"),
+		namespace:    os.Getenv("VAULT_NAMESPACE"),
+		token:        os.Getenv("VAULT_TOKEN"),
+		roleID:       os.Getenv("VAULT_ROLE_ID"),
+		secretID:     os.Getenv("VAULT_SECRET_ID"),
+		approleMount: strings.Trim(os.Getenv("VAULT_APPROLE_MOUNT"), "/"),
+		http:         &http.Client{Timeout: 30 * time.Second},
+	}
+	if c.addr == "" {
+		return nil, fmt.Errorf("VAULT_ADDR must be set to read passwords from Vault")
+	}
+	if c.token == "" && (c.roleID == "" || c.secretID == "") {
+		return nil, fmt.Errorf("VAULT_TOKEN or VAULT_ROLE_ID and VAULT_SECRET_ID must be set to read passwords from Vault")
+	}
+	if c.approleMount == "" {
+		c.approleMount = "approle"
+	}
+	return c, nil
+}
+
+// login exchanges the AppRole credentials for a token unless the client
+// already has one
+func (c *vaultClient) login(ctx context.Context) error {
+	if c.token != "" {
+		return nil
+	}
+	var resp struct {
+		Auth struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}
+	body := map[string]string{"role_id": c.roleID, "secret_id": c.secretID}
+	if err := c.do(ctx, http.MethodPost, "auth/"+c.approleMount+"/login", body, &resp); err != nil {
+		return fmt.Errorf("vault approle login failed: %w", err)
+	}
+	if resp.Auth.ClientToken == "" {
+		return fmt.Errorf("vault approle login returned no token")
+	}
+	c.token = resp.Auth.ClientToken
+	return nil
+}
+
+// readKV reads key from the KV v2 secret at path, which includes the data/
+// segment, such as secret/data/db/app
+func (c *vaultClient) readKV(ctx context.Context, path, key string) (string, error) {
+	if err := c.login(ctx); err != nil {
+		return "", err
+	}
+	var resp struct {
+		Data struct {
+			Data map[string]any `json:"data"`
+		} `json:"data"`
+	}
+	if err := c.do(ctx, http.MethodGet, path, nil, &resp); err != nil {
+		return "", fmt.Errorf("failed to read vault secret %s: %w", path, err)
+	}
+	value, ok := resp.Data.Data[key]
+	if !ok {
+		return "", fmt.Errorf("vault secret %s has no key %s", path, key)
+	}
+	s, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("vault secret %s key %s is not a string", path, key)
+	}
+	return s, nil
+}
+
+// do sends a request to the Vault HTTP API and decodes the JSON response into
+// out. Error responses are turned into errors with Vault's messages.
+func (c *vaultClient) do(ctx context.Context, method, path string, body, out any) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.addr+"/v1/"+strings.TrimLeft(path, "/"), reqBody)
+	if err != nil {
+		return err
+	}
+	if c.token != "" {
+		req.Header.Set("X-Vault-Token", c.token)
+	}
+	if c.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", c.namespace)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var vaultErr struct {
+			Errors []string `json:"errors"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&vaultErr) == nil && len(vaultErr.Errors) > 0 {
+			return fmt.Errorf("%s: %s", resp.Status, strings.Join(vaultErr.Errors, "; "))
+		}
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// splitVaultRef splits a password_vault reference of the form path#key
+func splitVaultRef(ref string) (path, key string, err error) {
+	i := strings.LastIndex(ref, "#")
+	if i <= 0 || i == len(ref)-1 {
+		return "", "", fmt.Errorf("invalid password_vault %q; expected <path>#<key>", ref)
+	}
+	return ref[:i], ref[i+1:], nil
+}
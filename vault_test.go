@@ -0,0 +1,102 @@
+package dbstrap
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// vaultStub stands in for a Vault server with one KV v2 secret at
+// secret/data/db/app and the AppRole auth method
+func vaultStub(t *testing.T) (*httptest.Server, *int) {
+	logins := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/auth/approle/login", func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"errors":["invalid request body"]}`))
+			return
+		}
+		if body["role_id"] != "app-role" || body["secret_id"] != "app-secret" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"errors":["invalid role or secret ID"]}`))
+			return
+		}
+		logins++
+		w.Write([]byte(`{"auth":{"client_token":"approle-token"}}`))
+	})
+	mux.HandleFunc("GET /v1/secret/data/db/app", func(w http.ResponseWriter, r *http.Request) {
+		if token := r.Header.Get("X-Vault-Token"); token != "root-token" && token != "approle-token" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		w.Write([]byte(`{"data":{"data":{"password":"v4ult","port":5432,"empty":""},"metadata":{"version":3}}}`))
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server, &logins
+}
+
+// TestReadPasswordVault tests reading passwords from Vault with a token
+func TestReadPasswordVault(t *testing.T) {
+	ctx := context.Background()
+	server, _ := vaultStub(t)
+	t.Setenv("VAULT_ADDR", server.URL)
+	t.Setenv("VAULT_TOKEN", "root-token")
+
+	reader := &passwordReader{}
+	pw, err := reader.read(ctx, User{Name: "app_user", PasswordVault: "secret/data/db/app#password"})
+	require.NoError(t, err)
+	assert.Equal(t, "v4ult", pw)
+
+	_, err = reader.read(ctx, User{Name: "app_user", PasswordVault: "secret/data/db/app#missing"})
+	assert.EqualError(t, err, "password_vault for user app_user: vault secret secret/data/db/app has no key missing")
+	_, err = reader.read(ctx, User{Name: "app_user", PasswordVault: "secret/data/db/app#port"})
+	assert.EqualError(t, err, "password_vault for user app_user: vault secret secret/data/db/app key port is not a string")
+	_, err = reader.read(ctx, User{Name: "app_user", PasswordVault: "secret/data/db/app#empty"})
+	assert.EqualError(t, err, "password_vault secret/data/db/app#empty for user app_user is empty")
+	_, err = reader.read(ctx, User{Name: "app_user", PasswordVault: "secret/data/db/other#password"})
+	assert.EqualError(t, err, "password_vault for user app_user: failed to read vault secret secret/data/db/other: 404 Not Found")
+	_, err = reader.read(ctx, User{Name: "app_user", PasswordVault: "secret/data/db/app"})
+	assert.EqualError(t, err, `invalid password_vault "secret/data/db/app"; expected <path>#<key>`)
+
+	reader = &passwordReader{}
+	t.Setenv("VAULT_TOKEN", "expired-token")
+	_, err = reader.read(ctx, User{Name: "app_user", PasswordVault: "secret/data/db/app#password"})
+	assert.EqualError(t, err, "password_vault for user app_user: failed to read vault secret secret/data/db/app: 403 Forbidden: permission denied")
+}
+
+// TestReadPasswordVaultAppRole tests that AppRole credentials are exchanged
+// for a token once per run
+func TestReadPasswordVaultAppRole(t *testing.T) {
+	ctx := context.Background()
+	server, logins := vaultStub(t)
+	t.Setenv("VAULT_ADDR", server.URL+"/")
+	t.Setenv("VAULT_TOKEN", "")
+	t.Setenv("VAULT_ROLE_ID", "app-role")
+	t.Setenv("VAULT_SECRET_ID", "app-secret")
+
+	config := &Config{Users: []User{
+		{Name: "app_user", PasswordVault: "secret/data/db/app#password"},
+		{Name: "reporting", PasswordVault: "secret/data/db/app#password"},
+	}}
+	require.NoError(t, loadPasswords(config, true, false))
+	assert.Equal(t, "v4ult", config.Users[0].Password)
+	assert.Equal(t, "v4ult", config.Users[1].Password)
+	assert.Equal(t, 1, *logins)
+
+	t.Setenv("VAULT_SECRET_ID", "wrong")
+	_, err := (&passwordReader{}).read(ctx, config.Users[0])
+	assert.EqualError(t, err, "password_vault for user app_user: vault approle login failed: 400 Bad Request: invalid role or secret ID")
+
+	t.Setenv("VAULT_SECRET_ID", "")
+	_, err = (&passwordReader{}).read(ctx, config.Users[0])
+	assert.EqualError(t, err, "VAULT_TOKEN or VAULT_ROLE_ID and VAULT_SECRET_ID must be set to read passwords from Vault")
+}